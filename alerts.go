@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/prometheus/prometheus/rules"
+)
+
+// AlertInfo is a pending or firing alert of an alerting rule
+type AlertInfo struct {
+	Name        string            `json:"name"`
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	ActiveAt    time.Time         `json:"activeAt"`
+	Value       float64           `json:"value"`
+}
+
+// activeAlerts returns the pending and firing alerts of every alerting rule in
+// groups, firing alerts first, then by name and labels
+func activeAlerts(groups []*ruleGroup) []AlertInfo {
+	alerts := []AlertInfo{}
+	for _, group := range groups {
+		for _, rule := range group.rules {
+			alertingRule, ok := rule.(*rules.AlertingRule)
+			if !ok {
+				continue
+			}
+			for _, alert := range alertingRule.ActiveAlerts() {
+				alerts = append(alerts, AlertInfo{
+					Name:        alertingRule.Name(),
+					State:       alert.State.String(),
+					Labels:      alert.Labels.Map(),
+					Annotations: alert.Annotations.Map(),
+					ActiveAt:    alert.ActiveAt,
+					Value:       alert.Value,
+				})
+			}
+		}
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].State != alerts[j].State {
+			return alerts[i].State == rules.StateFiring.String()
+		}
+		if alerts[i].Name != alerts[j].Name {
+			return alerts[i].Name < alerts[j].Name
+		}
+		return formatLabels(alerts[i].Labels) < formatLabels(alerts[j].Labels)
+	})
+	return alerts
+}
+
+// runAlerts collects metrics once, evaluates the alerting rules and lists the
+// alerts that are pending or firing
+func runAlerts(args []string) {
+	fs := flag.NewFlagSet("alerts", flag.ExitOnError)
+	var cluster clusterFlags
+	var output string
+	var rulesPattern string
+	engineOpts := DefaultEngineOptions()
+
+	cluster.register(fs)
+	fs.StringVar(&rulesPattern, "rules", "",
+		"Prometheus rule file, or glob of rule files, to evaluate (required)")
+	fs.StringVar(&output, "output", outputTable,
+		"Output format: table or json")
+	addEngineFlags(fs, &engineOpts)
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s alerts -rules <file> [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Evaluate the alerting rules of Prometheus rule files against the collected\n")
+		fmt.Fprintf(fs.Output(), "metrics and list the alerts that are firing or pending. Recording rules in\n")
+		fmt.Fprintf(fs.Output(), "the same files are evaluated first, in file order.\n\n")
+		fmt.Fprintf(fs.Output(), "Examples:\n")
+		fmt.Fprintf(fs.Output(), "  %s alerts -rules alerts.yaml\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s alerts -rules 'rules/*.yaml' -output json\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	cluster.parse(fs, args)
+
+	if rulesPattern == "" {
+		fmt.Fprintf(os.Stderr, "Error: -rules parameter is required\n\n")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := validateOutputFormat(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := applyEngineFlags(engineOpts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ruleGroups, err := loadRules(rulesPattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	store, err := cluster.collect(engineOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	if err := store.EvaluateRules(context.Background(), ruleGroups, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to evaluate rules: %v\n", err)
+	}
+
+	if err := displayAlerts(output, activeAlerts(ruleGroups)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestActiveAlerts(t *testing.T) {
+	groups, err := loadRules("testdata/rules/alerts.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := newStandardFakeCluster(t)
+	cluster.serveError(podProxyPath("kube-system", "kube-scheduler-node-a", 10259, "metrics"), http.StatusForbidden)
+	store := newTestStore(t)
+	if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Now()
+	if err := store.EvaluateRules(context.Background(), groups, ts); err != nil {
+		t.Fatalf("EvaluateRules: %v", err)
+	}
+
+	// Firing alerts come first; the alert with a for duration is pending
+	// after a single evaluation
+	want := []AlertInfo{
+		{
+			Name:        "KubeSchedulerDown",
+			State:       "firing",
+			Labels:      map[string]string{"alertname": "KubeSchedulerDown", "severity": "critical"},
+			Annotations: map[string]string{"summary": "The scheduler could not be scraped."},
+			Value:       1,
+		},
+		{
+			Name:        "KubeletTooManyPods",
+			State:       "firing",
+			Labels:      map[string]string{"alertname": "KubeletTooManyPods", "severity": "info"},
+			Annotations: map[string]string{"summary": "Kubelet is running 12 pods."},
+			Value:       12,
+		},
+		{
+			Name:        "KubeAPIServerNotFoundErrors",
+			State:       "pending",
+			Labels:      map[string]string{"alertname": "KubeAPIServerNotFoundErrors", "severity": "warning"},
+			Annotations: map[string]string{"summary": "The API server answered 12 requests with 404."},
+			Value:       12,
+		},
+	}
+	alerts := activeAlerts(groups)
+	for i := range alerts {
+		if !alerts[i].ActiveAt.Equal(ts) {
+			t.Errorf("%s active at %s, want %s", alerts[i].Name, alerts[i].ActiveAt, ts)
+		}
+		alerts[i].ActiveAt = time.Time{}
+	}
+	if !reflect.DeepEqual(alerts, want) {
+		t.Errorf("active alerts = %+v, want %+v", alerts, want)
+	}
+
+	// Alerting rules write the ALERTS series of their active alerts
+	values := queryValues(t, store, "ALERTS")
+	if len(values) != 3 || values[`{alertname=KubeAPIServerNotFoundErrors,alertstate=pending,severity=warning}`] != 1 {
+		t.Errorf("ALERTS = %v, want 3 series with KubeAPIServerNotFoundErrors pending", values)
+	}
+}
+
+func TestActiveAlertsFiringAfterFor(t *testing.T) {
+	groups, err := loadRules("testdata/rules/alerts.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A long lookback keeps the collected samples visible to the second
+	// evaluation, once the for duration has passed
+	opts := DefaultEngineOptions()
+	opts.LookbackDelta = 20 * time.Minute
+	store, err := NewMetricStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	cluster := newStandardFakeCluster(t)
+	if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for _, ts := range []time.Time{start, start.Add(15 * time.Minute)} {
+		if err := store.EvaluateRules(context.Background(), groups, ts); err != nil {
+			t.Fatalf("EvaluateRules at %s: %v", ts, err)
+		}
+	}
+
+	states := make(map[string]string)
+	for _, alert := range activeAlerts(groups) {
+		states[alert.Name] = alert.State
+	}
+	want := map[string]string{"KubeAPIServerNotFoundErrors": "firing", "KubeletTooManyPods": "firing"}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("alert states = %v, want %v", states, want)
+	}
+}
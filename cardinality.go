@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// defaultCardinalityLimit is the number of entries in each top list, as in Prometheus
+const defaultCardinalityLimit = 10
+
+// CardinalityStat is a single entry of a cardinality top list
+type CardinalityStat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// HeadStats are the totals of a cardinality report
+type HeadStats struct {
+	NumSeries     uint64 `json:"numSeries"`
+	NumLabelPairs int    `json:"numLabelPairs"`
+	MinTime       int64  `json:"minTime"`
+	MaxTime       int64  `json:"maxTime"`
+}
+
+// CardinalityReport mirrors the data of the Prometheus /api/v1/status/tsdb endpoint,
+// with memory reported per metric name rather than per label name
+type CardinalityReport struct {
+	HeadStats                   HeadStats         `json:"headStats"`
+	SeriesCountByMetricName     []CardinalityStat `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName  []CardinalityStat `json:"labelValueCountByLabelName"`
+	SeriesCountByLabelValuePair []CardinalityStat `json:"seriesCountByLabelValuePair"`
+	MemoryInBytesByMetricName   []CardinalityStat `json:"memoryInBytesByMetricName"`
+}
+
+// Cardinality computes the top limit entries of each cardinality list over
+// every series in the store
+func (s *MetricStore) Cardinality(limit int) CardinalityReport {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	seriesByMetric := make(map[string]uint64)
+	memoryByMetric := make(map[string]uint64)
+	seriesByPair := make(map[string]uint64)
+	valuesByName := make(map[string]map[string]struct{})
+
+	head := HeadStats{NumSeries: uint64(len(s.series))}
+	hasSamples := false
+	for _, series := range s.series {
+		metricName := series.SeriesLabels.Get(labels.MetricName)
+		seriesByMetric[metricName]++
+		memoryByMetric[metricName] += uint64(series.memoryBytes())
+
+		series.SeriesLabels.Range(func(l labels.Label) {
+			seriesByPair[l.Name+"="+l.Value]++
+			values, ok := valuesByName[l.Name]
+			if !ok {
+				values = make(map[string]struct{})
+				valuesByName[l.Name] = values
+			}
+			values[l.Value] = struct{}{}
+		})
+
+		if len(series.chunks) == 0 {
+			continue
+		}
+		minTime, maxTime := series.chunks[0].minTime, series.head().maxTime
+		if !hasSamples || minTime < head.MinTime {
+			head.MinTime = minTime
+		}
+		if !hasSamples || maxTime > head.MaxTime {
+			head.MaxTime = maxTime
+		}
+		hasSamples = true
+	}
+
+	valueCounts := make(map[string]uint64, len(valuesByName))
+	for name, values := range valuesByName {
+		valueCounts[name] = uint64(len(values))
+	}
+	head.NumLabelPairs = len(seriesByPair)
+
+	return CardinalityReport{
+		HeadStats:                   head,
+		SeriesCountByMetricName:     topCardinalityStats(seriesByMetric, limit),
+		LabelValueCountByLabelName:  topCardinalityStats(valueCounts, limit),
+		SeriesCountByLabelValuePair: topCardinalityStats(seriesByPair, limit),
+		MemoryInBytesByMetricName:   topCardinalityStats(memoryByMetric, limit),
+	}
+}
+
+// topCardinalityStats returns the limit entries of counts with the highest
+// values, ordered by value and then by name
+func topCardinalityStats(counts map[string]uint64, limit int) []CardinalityStat {
+	stats := make([]CardinalityStat, 0, len(counts))
+	for name, value := range counts {
+		stats = append(stats, CardinalityStat{Name: name, Value: value})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Value != stats[j].Value {
+			return stats[i].Value > stats[j].Value
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats
+}
+
+// runCardinality collects metrics once and reports which metrics and labels
+// contribute the most series
+func runCardinality(args []string) {
+	fs := flag.NewFlagSet("cardinality", flag.ExitOnError)
+	var cluster clusterFlags
+	var output string
+	var limit int
+
+	cluster.register(fs)
+	fs.StringVar(&output, "output", outputTable,
+		"Output format: table or json")
+	fs.IntVar(&limit, "limit", defaultCardinalityLimit,
+		"Number of entries to show in each list")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s cardinality [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Report the metric names with the most series, the label names with the most\n")
+		fmt.Fprintf(fs.Output(), "values, the label=value pairs with the most series and the memory used by\n")
+		fmt.Fprintf(fs.Output(), "each metric name, like the Prometheus TSDB status page.\n\n")
+		fmt.Fprintf(fs.Output(), "Examples:\n")
+		fmt.Fprintf(fs.Output(), "  %s cardinality\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s cardinality -limit 25 -output json\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	cluster.parse(fs, args)
+
+	if err := validateOutputFormat(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+	if limit <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -limit must be positive\n\n")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	store, err := cluster.collect(DefaultEngineOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	if err := displayCardinality(output, store.Cardinality(limit)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
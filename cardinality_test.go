@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// newCardinalityTestStore returns a store holding three a_total series, two
+// c series and one b series
+func newCardinalityTestStore(t *testing.T) *MetricStore {
+	t.Helper()
+
+	store := newTestStore(t)
+	for i, lbls := range []labels.Labels{
+		labels.FromStrings(labels.MetricName, "a_total", "code", "200", "x", "1"),
+		labels.FromStrings(labels.MetricName, "a_total", "code", "404", "x", "1"),
+		labels.FromStrings(labels.MetricName, "a_total", "code", "500", "x", "1"),
+		labels.FromStrings(labels.MetricName, "b", "code", "200"),
+		labels.FromStrings(labels.MetricName, "c", "pod", "p1"),
+		labels.FromStrings(labels.MetricName, "c", "pod", "p2"),
+	} {
+		store.appendSample(lbls, int64(i+1)*1000, 1)
+		store.appendSample(lbls, int64(i+10)*1000, 2)
+	}
+	return store
+}
+
+func TestCardinality(t *testing.T) {
+	store := newCardinalityTestStore(t)
+
+	report := store.Cardinality(defaultCardinalityLimit)
+	wantHead := HeadStats{NumSeries: 6, NumLabelPairs: 9, MinTime: 1000, MaxTime: 15000}
+	if report.HeadStats != wantHead {
+		t.Errorf("head stats = %+v, want %+v", report.HeadStats, wantHead)
+	}
+
+	tests := []struct {
+		name string
+		got  []CardinalityStat
+		want []CardinalityStat
+	}{
+		{"series by metric name", report.SeriesCountByMetricName, []CardinalityStat{
+			{"a_total", 3}, {"c", 2}, {"b", 1},
+		}},
+		// Ties are ordered by name
+		{"values by label name", report.LabelValueCountByLabelName, []CardinalityStat{
+			{"__name__", 3}, {"code", 3}, {"pod", 2}, {"x", 1},
+		}},
+		{"series by label pair", report.SeriesCountByLabelValuePair, []CardinalityStat{
+			{"__name__=a_total", 3}, {"x=1", 3}, {"__name__=c", 2}, {"code=200", 2},
+			{"__name__=b", 1}, {"code=404", 1}, {"code=500", 1}, {"pod=p1", 1}, {"pod=p2", 1},
+		}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	memory := report.MemoryInBytesByMetricName
+	if len(memory) != 3 || memory[0].Name != "a_total" || memory[0].Value <= memory[1].Value {
+		t.Errorf("memory by metric name = %v, want a_total first", memory)
+	}
+}
+
+func TestCardinalityLimit(t *testing.T) {
+	store := newCardinalityTestStore(t)
+
+	tests := []struct {
+		limit         int
+		wantMetrics   []CardinalityStat
+		wantPairCount int
+	}{
+		{1, []CardinalityStat{{"a_total", 3}}, 1},
+		{2, []CardinalityStat{{"a_total", 3}, {"c", 2}}, 2},
+		{100, []CardinalityStat{{"a_total", 3}, {"c", 2}, {"b", 1}}, 9},
+	}
+	for _, tt := range tests {
+		report := store.Cardinality(tt.limit)
+		if !reflect.DeepEqual(report.SeriesCountByMetricName, tt.wantMetrics) {
+			t.Errorf("limit %d: series by metric name = %v, want %v", tt.limit, report.SeriesCountByMetricName, tt.wantMetrics)
+		}
+		if n := len(report.SeriesCountByLabelValuePair); n != tt.wantPairCount {
+			t.Errorf("limit %d: %d label pairs listed, want %d", tt.limit, n, tt.wantPairCount)
+		}
+		// The totals are not limited
+		if report.HeadStats.NumSeries != 6 || report.HeadStats.NumLabelPairs != 9 {
+			t.Errorf("limit %d: head stats = %+v, want 6 series and 9 label pairs", tt.limit, report.HeadStats)
+		}
+	}
+}
+
+func TestCardinalityEmpty(t *testing.T) {
+	report := newTestStore(t).Cardinality(defaultCardinalityLimit)
+	if report.HeadStats != (HeadStats{}) || len(report.SeriesCountByMetricName) != 0 {
+		t.Errorf("empty store report = %+v, want no series", report)
+	}
+}
@@ -1,44 +1,146 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
+// kubeletPort is the kubelet's default secure port, used in direct mode when
+// a node does not report its own
+const kubeletPort = 10250
+
+// clusterLabel is added to every series when collecting from several clusters
+const clusterLabel = "cluster"
+
+// collectClusters collects metrics from every cluster concurrently into store
+func collectClusters(ctx context.Context, store *MetricStore, clients []*clusterClient, debug bool) error {
+	if len(clients) == 1 {
+		return collectAllMetrics(ctx, store, clients[0], debug)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(clients))
+	for i, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = collectAllMetrics(ctx, store, client, debug)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// collectOnce creates a store with the engine settings opts and collects
+// metrics from every cluster into it once, within collectionTimeout. The
+// caller must close the store.
+func collectOnce(clients []*clusterClient, opts EngineOptions, debug bool) (*MetricStore, error) {
+	store, err := NewMetricStore(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric store: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectionTimeout)
+	defer cancel()
+
+	fmt.Fprintln(os.Stderr, "Collecting metrics from Kubernetes components...")
+	if err := collectClusters(ctx, store, clients, debug); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to collect metrics: %w", err)
+	}
+	return store, nil
+}
+
 // collectAllMetrics collects metrics from all available Kubernetes components
-func collectAllMetrics(ctx context.Context, store *MetricStore, kubeConfig interface{}, insecureTLS, debug bool) error {
-	config := kubeConfig.(*rest.Config)
-	
+// of a cluster. Targets of a named cluster are called cluster/component and
+// their series get a cluster label.
+func collectAllMetrics(ctx context.Context, store *MetricStore, client *clusterClient, debug bool) error {
 	// Collect from multiple components in parallel
 	components := []string{"apiserver", "kubelet", "node", "scheduler", "controller-manager"}
 	
+	var targetLabels labels.Labels
+	if client.cluster != "" {
+		targetLabels = labels.FromStrings(clusterLabel, client.cluster)
+	}
+	
 	for _, component := range components {
+		target := component
+		if client.cluster != "" {
+			target = client.cluster + "/" + component
+		}
 		if debug {
-			fmt.Printf("Debug: Collecting metrics from %s...\n", component)
+			fmt.Printf("Debug: Collecting metrics from %s...\n", target)
 		}
 		
-		families, err := collectComponentMetrics(ctx, config, component, "", insecureTLS, debug)
+		start := time.Now()
+		policy := client.retries.forComponent(component)
+		result, retries, err := policy.scrape(ctx, func() (*scrapeResult, error) {
+			return collectComponentMetrics(ctx, client, component, "", debug)
+		}, func(retry int, delay time.Duration, err error) {
+			if debug {
+				fmt.Printf("Debug: Retrying %s in %v (retry %d of %d): %v\n", target, delay.Round(time.Millisecond), retry, policy.maxAttempts-1, err)
+			}
+		})
+		status := TargetStatus{
+			Name:       target,
+			Cluster:    client.cluster,
+			Labels:     map[string]string{"job": component},
+			LastScrape: start,
+			Duration:   time.Since(start),
+			Retries:    retries,
+			Health:     healthUp,
+		}
+		if client.cluster != "" {
+			status.Labels[clusterLabel] = client.cluster
+		}
+		var families map[string]*dto.MetricFamily
+		if result != nil {
+			families = result.families
+			status.ScrapeURL = result.url
+			status.DiscoveredLabels = result.labels
+			status.Labels["instance"] = result.labels[model.AddressLabel]
+			status.Families = len(families)
+			status.Samples = countSamples(families)
+		}
+		store.addRetries(component, targetLabels, retries)
 		if err != nil {
+			// Failed targets are reported with every query as storage warnings
+			status.Health = healthDown
+			status.LastError = err.Error()
+			status.ErrorKind = errorKind(err)
+			store.UpdateTarget(status)
 			if debug {
-				fmt.Printf("Warning: Failed to collect metrics from %s: %v\n", component, err)
+				fmt.Printf("Warning: Failed to collect metrics from %s: %v\n", target, err)
 			}
 			continue // Continue with other components even if one fails
 		}
 		
+		store.UpdateTarget(status)
 		if families != nil {
-			store.AddMetricFamilies(families)
+			store.AddMetricFamilies(target, targetLabels, families)
 			if debug {
-				fmt.Printf("Debug: Added %d metric families from %s\n", len(families), component)
+				fmt.Printf("Debug: Added %d metric families from %s\n", len(families), target)
 			}
 		}
 	}
@@ -46,305 +148,332 @@ func collectAllMetrics(ctx context.Context, store *MetricStore, kubeConfig inter
 	return nil
 }
 
-// collectComponentMetrics collects metrics from a specific Kubernetes component
-func collectComponentMetrics(ctx context.Context, config *rest.Config, component, componentName string, insecureTLS, debug bool) (map[string]*dto.MetricFamily, error) {
-	switch component {
-	case "apiserver":
-		return collectAPIServerMetrics(ctx, config)
-	case "kubelet":
-		return collectKubeletMetrics(ctx, config, componentName, insecureTLS)
-	case "node":
-		return collectNodeMetrics(ctx, config, componentName, insecureTLS)
-	case "etcd":
-		return collectEtcdMetrics(ctx, config, componentName, insecureTLS)
-	case "scheduler":
-		return collectSchedulerMetrics(ctx, config, componentName, insecureTLS)
-	case "controller-manager":
-		return collectControllerManagerMetrics(ctx, config, componentName, insecureTLS)
-	case "kube-proxy":
-		return collectKubeProxyMetrics(ctx, config, componentName, insecureTLS)
-	default:
-		return nil, fmt.Errorf("unsupported component: %s", component)
-	}
-}
+// storeCollector repeatedly collects metrics from a cluster into a single store
+type storeCollector struct {
+	store   *MetricStore
+	clients []*clusterClient
+	cluster clusterFlags
 
-// collectAPIServerMetrics collects metrics from the Kubernetes API server
-func collectAPIServerMetrics(ctx context.Context, config *rest.Config) (map[string]*dto.MetricFamily, error) {
-	httpClient, err := rest.HTTPClientFor(config)
-	if err != nil {
-		return nil, fmt.Errorf("creating HTTP client: %v", err)
-	}
+	// ruleGroups are evaluated after every collection
+	ruleGroups []*ruleGroup
+
+	// notifier, when set, sends the resulting alerts to Alertmanagers
+	notifier *alertNotifier
 
-	metricsURL := config.Host + "/metrics"
-	return scrapeMetrics(ctx, httpClient, metricsURL)
+	// mutex serialises collections started on demand and from collectEvery
+	mutex sync.Mutex
+
+	// collected is set once the first collection has completed
+	collected atomic.Bool
 }
 
-// collectKubeletMetrics collects metrics from kubelet using RESTClient
-func collectKubeletMetrics(ctx context.Context, config *rest.Config, nodeName string, insecureTLS bool) (map[string]*dto.MetricFamily, error) {
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("creating kubernetes client: %v", err)
+// collect scrapes all components into the store, evaluates the rules and
+// sends the resulting alerts
+func (c *storeCollector) collect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectionTimeout)
+	defer cancel()
+
+	if err := collectClusters(ctx, c.store, c.clients, c.cluster.debug); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to collect metrics: %v\n", err)
+		return
+	}
+	ts := time.Now()
+	if err := c.store.EvaluateRules(ctx, c.ruleGroups, ts); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to evaluate rules: %v\n", err)
+	}
+	if c.notifier != nil {
+		// A slow collection must not use up the time for sending alerts
+		notifyCtx, cancel := context.WithTimeout(context.Background(), notifyRoundTimeout)
+		defer cancel()
+		if err := c.notifier.notify(notifyCtx, c.ruleGroups, ts); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to send alerts: %v\n", err)
+		}
 	}
+	c.collected.Store(true)
+}
 
-	// Get the first node if no specific node name provided
-	if nodeName == "" {
-		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{Limit: 1})
-		if err != nil {
-			return nil, fmt.Errorf("listing nodes: %v", err)
+// collectEvery collects metrics every interval until ctx is done
+func (c *storeCollector) collectEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.collect()
 		}
-		if len(nodes.Items) == 0 {
-			return nil, fmt.Errorf("no nodes found")
-		}
-		nodeName = nodes.Items[0].Name
 	}
+}
 
-	// Verify node exists
-	_, err = clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("getting node %s: %v", nodeName, err)
-	}
+// clusterClient holds the clients collectors use to reach a cluster: a
+// clientset to discover nodes and pods, and an authenticated HTTP client for
+// the API server's /metrics route and its node and pod proxy routes
+type clusterClient struct {
+	clientset  kubernetes.Interface
+	httpClient *http.Client
+	host       string
 
-	// Use RESTClient to access kubelet metrics via node proxy
-	restClient := clientset.CoreV1().RESTClient()
-	result := restClient.Get().
-		Resource("nodes").
-		Name(nodeName).
-		SubResource("proxy").
-		Suffix("metrics").
-		Do(ctx)
+	// direct, when set, scrapes kubelets and control-plane pods on their own
+	// addresses instead of through the API server proxy
+	direct *http.Client
 
-	if err := result.Error(); err != nil {
-		return nil, fmt.Errorf("failed to get kubelet metrics via node proxy: %v", err)
-	}
+	// cluster names the cluster when collecting from several, and is empty
+	// otherwise
+	cluster string
 
-	rawBody, err := result.Raw()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get raw response body: %v", err)
-	}
+	// namespace, when set, is where control-plane pods are discovered
+	// instead of kube-system
+	namespace string
+
+	// maxResponseSize caps the bytes read from a scrape, without a cap when 0
+	maxResponseSize int64
 
-	return parseMetricsBody(rawBody)
+	// retries decides which failed scrapes of each component are retried;
+	// none are without policies
+	retries retryPolicies
 }
 
-// collectNodeMetrics collects node resource metrics from kubelet using RESTClient
-func collectNodeMetrics(ctx context.Context, config *rest.Config, nodeName string, insecureTLS bool) (map[string]*dto.MetricFamily, error) {
-	clientset, err := kubernetes.NewForConfig(config)
+// newClusterClient creates the clients for the cluster described by config.
+// The clientset and the HTTP client share one transport.
+func newClusterClient(config *rest.Config) (*clusterClient, error) {
+	httpClient, err := rest.HTTPClientFor(config)
 	if err != nil {
-		return nil, fmt.Errorf("creating kubernetes client: %v", err)
-	}
-
-	// Get the first node if no specific node name provided
-	if nodeName == "" {
-		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{Limit: 1})
-		if err != nil {
-			return nil, fmt.Errorf("listing nodes: %v", err)
-		}
-		if len(nodes.Items) == 0 {
-			return nil, fmt.Errorf("no nodes found")
-		}
-		nodeName = nodes.Items[0].Name
+		return nil, fmt.Errorf("creating HTTP client: %v", err)
 	}
 
-	// Verify node exists
-	_, err = clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	clientset, err := kubernetes.NewForConfigAndClient(config, httpClient)
 	if err != nil {
-		return nil, fmt.Errorf("getting node %s: %v", nodeName, err)
+		return nil, fmt.Errorf("creating kubernetes client: %v", err)
 	}
 
-	// Use RESTClient to access cAdvisor metrics via node proxy
-	restClient := clientset.CoreV1().RESTClient()
-	result := restClient.Get().
-		Resource("nodes").
-		Name(nodeName).
-		SubResource("proxy").
-		Suffix("metrics/cadvisor").
-		Do(ctx)
-
-	if err := result.Error(); err != nil {
-		return nil, fmt.Errorf("failed to get cAdvisor metrics via node proxy: %v", err)
-	}
+	return &clusterClient{
+		clientset:  clientset,
+		httpClient: httpClient,
+		host:       strings.TrimSuffix(config.Host, "/"),
+	}, nil
+}
 
-	rawBody, err := result.Raw()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get raw response body: %v", err)
+// componentNamespace returns the namespace control-plane pods are discovered in
+func (c *clusterClient) componentNamespace() string {
+	if c.namespace != "" {
+		return c.namespace
 	}
-
-	return parseMetricsBody(rawBody)
+	return "kube-system"
 }
 
-// collectEtcdMetrics collects metrics from etcd using pod proxy
-func collectEtcdMetrics(ctx context.Context, config *rest.Config, componentName string, insecureTLS bool) (map[string]*dto.MetricFamily, error) {
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("creating kubernetes client: %v", err)
-	}
+// scrapeResult is the outcome of scraping a target: the URL scraped, on the
+// API server or the component itself, the labels discovery found for the
+// target, and the metric families it exposed
+type scrapeResult struct {
+	url      string
+	labels   map[string]string
+	families map[string]*dto.MetricFamily
+}
 
-	// Find etcd pod in kube-system namespace
-	pods, err := clientset.CoreV1().Pods("kube-system").List(ctx, metav1.ListOptions{
-		LabelSelector: "component=etcd",
-	})
-	if err != nil {
-		return nil, fmt.Errorf("listing etcd pods: %v", err)
+// scrape scrapes rawURL with httpClient. The result describes the target
+// even when the scrape fails, and metaLabels are added to its discovered
+// labels like Prometheus' __meta_ labels.
+func (c *clusterClient) scrape(ctx context.Context, httpClient *http.Client, rawURL string, metaLabels map[string]string) (*scrapeResult, error) {
+	result := &scrapeResult{url: rawURL, labels: map[string]string{}}
+	if u, err := url.Parse(rawURL); err == nil {
+		result.labels[model.AddressLabel] = u.Host
+		result.labels[model.SchemeLabel] = u.Scheme
+		result.labels[model.MetricsPathLabel] = u.Path
 	}
-
-	if len(pods.Items) == 0 {
-		return nil, fmt.Errorf("no etcd pods found")
+	for name, value := range metaLabels {
+		result.labels[name] = value
 	}
 
-	etcdPod := pods.Items[0]
+	families, err := scrapeMetrics(ctx, httpClient, rawURL, c.maxResponseSize)
+	result.families = families
+	return result, err
+}
 
-	// Use RESTClient to access etcd metrics via pod proxy
-	// Default etcd metrics port is 2381
-	restClient := clientset.CoreV1().RESTClient()
-	result := restClient.Get().
-		Namespace("kube-system").
-		Resource("pods").
-		Name(etcdPod.Name + ":2381").
-		SubResource("proxy").
-		Suffix("metrics").
-		Do(ctx)
+// scrapePath scrapes metrics from a path on the API server
+func (c *clusterClient) scrapePath(ctx context.Context, path string, metaLabels map[string]string) (*scrapeResult, error) {
+	return c.scrape(ctx, c.httpClient, c.host+path, metaLabels)
+}
 
-	if err := result.Error(); err != nil {
-		return nil, fmt.Errorf("failed to get etcd metrics via pod proxy: %v", err)
+// scrapeNode scrapes path on the kubelet of node
+func (c *clusterClient) scrapeNode(ctx context.Context, node *v1.Node, path string) (*scrapeResult, error) {
+	metaLabels := map[string]string{"__meta_kubernetes_node_name": node.Name}
+	if c.direct == nil {
+		return c.scrapePath(ctx, nodeProxyPath(node.Name, path), metaLabels)
 	}
 
-	rawBody, err := result.Raw()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get raw response body: %v", err)
+	address := getNodeAddress(node)
+	if address == "" {
+		return nil, fmt.Errorf("node %s has no internal or external IP", node.Name)
 	}
-
-	return parseMetricsBody(rawBody)
+	port := int(node.Status.DaemonEndpoints.KubeletEndpoint.Port)
+	if port == 0 {
+		port = kubeletPort
+	}
+	return c.scrape(ctx, c.direct, "https://"+net.JoinHostPort(address, strconv.Itoa(port))+"/"+path, metaLabels)
 }
 
-// collectSchedulerMetrics collects metrics from kube-scheduler using pod proxy
-func collectSchedulerMetrics(ctx context.Context, config *rest.Config, componentName string, insecureTLS bool) (map[string]*dto.MetricFamily, error) {
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("creating kubernetes client: %v", err)
+// scrapePod scrapes path on a pod port. scheme is only used in direct mode,
+// the pod proxy picks the scheme of the port itself.
+func (c *clusterClient) scrapePod(ctx context.Context, pod *v1.Pod, scheme string, port int, path string) (*scrapeResult, error) {
+	metaLabels := map[string]string{
+		"__meta_kubernetes_namespace": pod.Namespace,
+		"__meta_kubernetes_pod_name":  pod.Name,
 	}
-
-	// Find scheduler pod in kube-system namespace
-	pods, err := clientset.CoreV1().Pods("kube-system").List(ctx, metav1.ListOptions{
-		LabelSelector: "component=kube-scheduler",
-	})
-	if err != nil {
-		return nil, fmt.Errorf("listing scheduler pods: %v", err)
+	if c.direct == nil {
+		return c.scrapePath(ctx, podProxyPath(pod.Namespace, pod.Name, port, path), metaLabels)
 	}
 
-	if len(pods.Items) == 0 {
-		return nil, fmt.Errorf("no kube-scheduler pods found")
+	if pod.Status.PodIP == "" {
+		return nil, fmt.Errorf("pod %s/%s has no IP", pod.Namespace, pod.Name)
 	}
+	return c.scrape(ctx, c.direct, scheme+"://"+net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port))+"/"+path, metaLabels)
+}
 
-	schedulerPod := pods.Items[0]
+// via describes how components are reached through proxy, for error messages
+func (c *clusterClient) via(proxy string) string {
+	if c.direct != nil {
+		return "directly"
+	}
+	return "via " + proxy + " proxy"
+}
 
-	// Use RESTClient to access scheduler metrics via pod proxy
-	// Default scheduler metrics port is 10259
-	restClient := clientset.CoreV1().RESTClient()
-	result := restClient.Get().
-		Namespace("kube-system").
-		Resource("pods").
-		Name(schedulerPod.Name + ":10259").
-		SubResource("proxy").
-		Suffix("metrics").
-		Do(ctx)
+// nodeProxyPath returns the API server path proxying to path on a node's kubelet
+func nodeProxyPath(nodeName, path string) string {
+	return "/api/v1/nodes/" + url.PathEscape(nodeName) + "/proxy/" + path
+}
 
-	if err := result.Error(); err != nil {
-		return nil, fmt.Errorf("failed to get scheduler metrics via pod proxy: %v", err)
-	}
+// podProxyPath returns the API server path proxying to path on a pod port
+func podProxyPath(namespace, podName string, port int, path string) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/pods/%s:%d/proxy/%s",
+		url.PathEscape(namespace), url.PathEscape(podName), port, path)
+}
 
-	rawBody, err := result.Raw()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get raw response body: %v", err)
+// collectComponentMetrics collects metrics from a specific Kubernetes component
+func collectComponentMetrics(ctx context.Context, client *clusterClient, component, componentName string, debug bool) (*scrapeResult, error) {
+	switch component {
+	case "apiserver":
+		return collectAPIServerMetrics(ctx, client)
+	case "kubelet":
+		return collectKubeletMetrics(ctx, client, componentName)
+	case "node":
+		return collectNodeMetrics(ctx, client, componentName)
+	case "etcd":
+		return collectEtcdMetrics(ctx, client, componentName)
+	case "scheduler":
+		return collectSchedulerMetrics(ctx, client, componentName)
+	case "controller-manager":
+		return collectControllerManagerMetrics(ctx, client, componentName)
+	case "kube-proxy":
+		return collectKubeProxyMetrics(ctx, client, componentName)
+	default:
+		return nil, fmt.Errorf("unsupported component: %s", component)
 	}
+}
 
-	return parseMetricsBody(rawBody)
+// collectAPIServerMetrics collects metrics from the Kubernetes API server
+func collectAPIServerMetrics(ctx context.Context, client *clusterClient) (*scrapeResult, error) {
+	return client.scrapePath(ctx, "/metrics", nil)
 }
 
-// collectControllerManagerMetrics collects metrics from kube-controller-manager using pod proxy
-func collectControllerManagerMetrics(ctx context.Context, config *rest.Config, componentName string, insecureTLS bool) (map[string]*dto.MetricFamily, error) {
-	clientset, err := kubernetes.NewForConfig(config)
+// collectKubeletMetrics collects metrics from kubelet via the node proxy
+func collectKubeletMetrics(ctx context.Context, client *clusterClient, nodeName string) (*scrapeResult, error) {
+	node, err := resolveNode(ctx, client, nodeName)
 	if err != nil {
-		return nil, fmt.Errorf("creating kubernetes client: %v", err)
+		return nil, err
 	}
 
-	// Find controller manager pod in kube-system namespace
-	pods, err := clientset.CoreV1().Pods("kube-system").List(ctx, metav1.ListOptions{
-		LabelSelector: "component=kube-controller-manager",
-	})
+	result, err := client.scrapeNode(ctx, node, "metrics")
 	if err != nil {
-		return nil, fmt.Errorf("listing controller manager pods: %v", err)
+		return result, fmt.Errorf("failed to get kubelet metrics %s: %w", client.via("node"), err)
 	}
+	return result, nil
+}
 
-	if len(pods.Items) == 0 {
-		return nil, fmt.Errorf("no kube-controller-manager pods found")
+// collectNodeMetrics collects node resource metrics from cAdvisor via the node proxy
+func collectNodeMetrics(ctx context.Context, client *clusterClient, nodeName string) (*scrapeResult, error) {
+	node, err := resolveNode(ctx, client, nodeName)
+	if err != nil {
+		return nil, err
 	}
 
-	controllerPod := pods.Items[0]
-
-	// Use RESTClient to access controller manager metrics via pod proxy
-	// Default controller manager metrics port is 10257
-	restClient := clientset.CoreV1().RESTClient()
-	result := restClient.Get().
-		Namespace("kube-system").
-		Resource("pods").
-		Name(controllerPod.Name + ":10257").
-		SubResource("proxy").
-		Suffix("metrics").
-		Do(ctx)
+	result, err := client.scrapeNode(ctx, node, "metrics/cadvisor")
+	if err != nil {
+		return result, fmt.Errorf("failed to get cAdvisor metrics %s: %w", client.via("node"), err)
+	}
+	return result, nil
+}
 
-	if err := result.Error(); err != nil {
-		return nil, fmt.Errorf("failed to get controller manager metrics via pod proxy: %v", err)
+// resolveNode returns the node called nodeName, or the first node of the
+// cluster when nodeName is empty
+func resolveNode(ctx context.Context, client *clusterClient, nodeName string) (*v1.Node, error) {
+	// Get the first node if no specific node name provided
+	if nodeName == "" {
+		nodes, err := client.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{Limit: 1})
+		if err != nil {
+			return nil, fmt.Errorf("listing nodes: %w", err)
+		}
+		if len(nodes.Items) == 0 {
+			return nil, fmt.Errorf("no nodes found")
+		}
+		return &nodes.Items[0], nil
 	}
 
-	rawBody, err := result.Raw()
+	node, err := client.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get raw response body: %v", err)
+		return nil, fmt.Errorf("getting node %s: %w", nodeName, err)
 	}
+	return node, nil
+}
+
+// collectEtcdMetrics collects metrics from etcd using pod proxy
+func collectEtcdMetrics(ctx context.Context, client *clusterClient, componentName string) (*scrapeResult, error) {
+	// Default etcd metrics port is 2381
+	return collectPodMetrics(ctx, client, "etcd", "component=etcd", "http", 2381)
+}
 
-	return parseMetricsBody(rawBody)
+// collectSchedulerMetrics collects metrics from kube-scheduler using pod proxy
+func collectSchedulerMetrics(ctx context.Context, client *clusterClient, componentName string) (*scrapeResult, error) {
+	// Default scheduler metrics port is 10259
+	return collectPodMetrics(ctx, client, "kube-scheduler", "component=kube-scheduler", "https", 10259)
+}
+
+// collectControllerManagerMetrics collects metrics from kube-controller-manager using pod proxy
+func collectControllerManagerMetrics(ctx context.Context, client *clusterClient, componentName string) (*scrapeResult, error) {
+	// Default controller manager metrics port is 10257
+	return collectPodMetrics(ctx, client, "kube-controller-manager", "component=kube-controller-manager", "https", 10257)
 }
 
 // collectKubeProxyMetrics collects metrics from kube-proxy using pod proxy
-func collectKubeProxyMetrics(ctx context.Context, config *rest.Config, componentName string, insecureTLS bool) (map[string]*dto.MetricFamily, error) {
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("creating kubernetes client: %v", err)
-	}
+func collectKubeProxyMetrics(ctx context.Context, client *clusterClient, componentName string) (*scrapeResult, error) {
+	// Default kube-proxy metrics port is 10249
+	return collectPodMetrics(ctx, client, "kube-proxy", "k8s-app=kube-proxy", "http", 10249)
+}
 
-	// Find kube-proxy pods in kube-system namespace
-	pods, err := clientset.CoreV1().Pods("kube-system").List(ctx, metav1.ListOptions{
-		LabelSelector: "k8s-app=kube-proxy",
+// collectPodMetrics collects metrics through the pod proxy from the first pod
+// of the component namespace matching selector
+func collectPodMetrics(ctx context.Context, client *clusterClient, name, selector, scheme string, port int) (*scrapeResult, error) {
+	pods, err := client.clientset.CoreV1().Pods(client.componentNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: selector,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("listing kube-proxy pods: %v", err)
+		return nil, fmt.Errorf("listing %s pods: %w", name, err)
 	}
 
 	if len(pods.Items) == 0 {
-		return nil, fmt.Errorf("no kube-proxy pods found")
+		return nil, fmt.Errorf("no %s pods found", name)
 	}
 
-	proxyPod := pods.Items[0]
-
-	// Use RESTClient to access kube-proxy metrics via pod proxy
-	// Default kube-proxy metrics port is 10249
-	restClient := clientset.CoreV1().RESTClient()
-	result := restClient.Get().
-		Namespace("kube-system").
-		Resource("pods").
-		Name(proxyPod.Name + ":10249").
-		SubResource("proxy").
-		Suffix("metrics").
-		Do(ctx)
-
-	if err := result.Error(); err != nil {
-		return nil, fmt.Errorf("failed to get kube-proxy metrics via pod proxy: %v", err)
-	}
-
-	rawBody, err := result.Raw()
+	pod := pods.Items[0]
+	result, err := client.scrapePod(ctx, &pod, scheme, port, "metrics")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get raw response body: %v", err)
+		return result, fmt.Errorf("failed to get %s metrics %s: %w", name, client.via("pod"), err)
 	}
-
-	return parseMetricsBody(rawBody)
+	return result, nil
 }
 
 // getNodeAddress returns the node's IP address
@@ -363,14 +492,9 @@ func getNodeAddress(node *v1.Node) string {
 	return ""
 }
 
-// parseMetricsBody parses raw metrics response body into MetricFamily map
-func parseMetricsBody(body []byte) (map[string]*dto.MetricFamily, error) {
-	var parser expfmt.TextParser
-	return parser.TextToMetricFamilies(strings.NewReader(string(body)))
-}
-
-// scrapeMetrics performs GET request and returns parsed metric families
-func scrapeMetrics(ctx context.Context, client *http.Client, url string) (map[string]*dto.MetricFamily, error) {
+// scrapeMetrics performs GET request and returns parsed metric families.
+// Responses larger than maxBytes are rejected unless maxBytes is 0.
+func scrapeMetrics(ctx context.Context, client *http.Client, url string, maxBytes int64) (map[string]*dto.MetricFamily, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request for %s: %w", url, err)
@@ -387,15 +511,38 @@ func scrapeMetrics(ctx context.Context, client *http.Client, url string) (map[st
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return nil, fmt.Errorf("failed GET %s: status code %d (%s)\nResponse snippet: %s", 
-			url, resp.StatusCode, resp.Status, string(bodyBytes))
+		statusErr := &scrapeStatusError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Snippet:    string(bodyBytes),
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			statusErr.Rejection = rejection(resp)
+		}
+		return nil, statusErr
+	}
+
+	body := io.Reader(resp.Body)
+	if maxBytes > 0 {
+		if resp.ContentLength > maxBytes {
+			return nil, fmt.Errorf("response from %s is %d bytes, over the %d byte limit", url, resp.ContentLength, maxBytes)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body from %s: %w", url, err)
+		}
+		if int64(len(data)) > maxBytes {
+			return nil, fmt.Errorf("response from %s is over the %d byte limit", url, maxBytes)
+		}
+		body = bytes.NewReader(data)
 	}
 
 	var parser expfmt.TextParser
-	metricFamilies, err := parser.TextToMetricFamilies(resp.Body)
+	metricFamilies, err := parser.TextToMetricFamilies(body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse response body from %s: %w", url, err)
+		return nil, &parseError{url: url, err: err}
 	}
 
 	return metricFamilies, nil
-}
\ No newline at end of file
+}
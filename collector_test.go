@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestStore(t testing.TB) *MetricStore {
+	t.Helper()
+
+	store, err := NewMetricStore(DefaultEngineOptions())
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// targetsByName returns the target statuses of store keyed by name
+func targetsByName(store *MetricStore) map[string]TargetStatus {
+	targets := make(map[string]TargetStatus)
+	for _, target := range store.Targets() {
+		targets[target.Name] = target
+	}
+	return targets
+}
+
+// queryValues runs query and returns the values of its results keyed by formatted labels
+func queryValues(t *testing.T, store *MetricStore, query string) map[string]float64 {
+	t.Helper()
+
+	result, err := store.ExecutePromQL(context.Background(), query)
+	if err != nil {
+		t.Fatalf("query %q: %v", query, err)
+	}
+	values := make(map[string]float64, len(result.Results))
+	for _, r := range result.Results {
+		values[formatLabels(r.Labels)] = r.Value
+	}
+	return values
+}
+
+func TestCollectAllMetrics(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	store := newTestStore(t)
+
+	if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+
+	wantFamilies := map[string]int{
+		"apiserver":          3,
+		"kubelet":            3,
+		"node":               2,
+		"scheduler":          1,
+		"controller-manager": 1,
+	}
+	targets := targetsByName(store)
+	if len(targets) != len(wantFamilies) {
+		t.Errorf("got %d targets, want %d", len(targets), len(wantFamilies))
+	}
+	for name, families := range wantFamilies {
+		target, ok := targets[name]
+		if !ok {
+			t.Errorf("target %s missing", name)
+			continue
+		}
+		if target.Health != healthUp {
+			t.Errorf("target %s health = %s (%s), want %s", name, target.Health, target.LastError, healthUp)
+		}
+		if target.Families != families {
+			t.Errorf("target %s families = %d, want %d", name, target.Families, families)
+		}
+	}
+
+	wantPaths := []string{
+		"/metrics",
+		"/api/v1/nodes/node-a/proxy/metrics",
+		"/api/v1/nodes/node-a/proxy/metrics/cadvisor",
+		"/api/v1/namespaces/kube-system/pods/kube-scheduler-node-a:10259/proxy/metrics",
+		"/api/v1/namespaces/kube-system/pods/kube-controller-manager-node-a:10257/proxy/metrics",
+	}
+	if got := cluster.requested(); !slices.Equal(got, wantPaths) {
+		t.Errorf("requested paths = %v, want %v", got, wantPaths)
+	}
+}
+
+func TestCollectAllMetricsLabels(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	store := newTestStore(t)
+
+	if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  map[string]float64
+	}{
+		{
+			query: "kubelet_running_pods",
+			want:  map[string]float64{"{}": 12},
+		},
+		{
+			query: `apiserver_request_total{verb="GET"}`,
+			want: map[string]float64{
+				"{code=200,component=apiserver,group=,resource=pods,scope=namespace,verb=GET,version=v1}": 1234,
+				"{code=404,component=apiserver,group=,resource=pods,scope=namespace,verb=GET,version=v1}": 12,
+			},
+		},
+		{
+			query: `sum by (namespace) (container_memory_working_set_bytes)`,
+			want:  map[string]float64{"{namespace=kube-system}": 18128896 + 45678592},
+		},
+		{
+			// Histograms are stored as their sample count
+			query: "apiserver_request_duration_seconds",
+			want:  map[string]float64{"{verb=GET}": 1246},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got := queryValues(t, store, tt.query)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for lbls, want := range tt.want {
+				if got[lbls] != want {
+					t.Errorf("%s = %v, want %v", lbls, got[lbls], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectAllMetricsMetadata(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	store := newTestStore(t)
+
+	if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+
+	var found bool
+	for _, metric := range store.Metrics() {
+		if metric.Name != "apiserver_request_total" {
+			continue
+		}
+		found = true
+		if metric.Type != model.MetricTypeCounter {
+			t.Errorf("type = %s, want counter", metric.Type)
+		}
+		if metric.Series != 3 {
+			t.Errorf("series = %d, want 3", metric.Series)
+		}
+		if !slices.Equal(metric.Targets, []string{"apiserver"}) {
+			t.Errorf("targets = %v, want [apiserver]", metric.Targets)
+		}
+		if !strings.HasPrefix(metric.Help, "[STABLE] Counter of apiserver requests") {
+			t.Errorf("help = %q", metric.Help)
+		}
+	}
+	if !found {
+		t.Fatal("apiserver_request_total not listed")
+	}
+}
+
+func TestCollectAllMetricsFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(cluster *fakeCluster)
+		target    string
+		wantError string
+		wantKind  string
+	}{
+		{
+			name: "api server forbidden",
+			setup: func(cluster *fakeCluster) {
+				cluster.serveError("/metrics", http.StatusForbidden)
+			},
+			target:    "apiserver",
+			wantError: "status code 403",
+			wantKind:  errorKindForbidden,
+		},
+		{
+			name: "kubelet proxy unavailable",
+			setup: func(cluster *fakeCluster) {
+				cluster.serveError(nodeProxyPath("node-a", "metrics"), http.StatusServiceUnavailable)
+			},
+			target:    "kubelet",
+			wantError: "failed to get kubelet metrics via node proxy",
+			wantKind:  errorKindServerError,
+		},
+		{
+			name: "scheduler pod missing",
+			setup: func(cluster *fakeCluster) {
+				cluster.clientset.CoreV1().Pods("kube-system").Delete(context.Background(), "kube-scheduler-node-a", metav1.DeleteOptions{})
+			},
+			target:    "scheduler",
+			wantError: "no kube-scheduler pods found",
+			wantKind:  errorKindOther,
+		},
+		{
+			name: "controller-manager invalid exposition",
+			setup: func(cluster *fakeCluster) {
+				cluster.serve(podProxyPath("kube-system", "kube-controller-manager-node-a", 10257, "metrics"), http.StatusOK,
+					[]byte("workqueue_depth{name=\"deployment\" 0\n"))
+			},
+			target:    "controller-manager",
+			wantError: "failed to parse response body",
+			wantKind:  errorKindParse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newStandardFakeCluster(t)
+			tt.setup(cluster)
+			store := newTestStore(t)
+
+			if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+				t.Fatalf("collectAllMetrics: %v", err)
+			}
+
+			for name, target := range targetsByName(store) {
+				if name != tt.target {
+					if target.Health != healthUp {
+						t.Errorf("target %s health = %s (%s), want %s", name, target.Health, target.LastError, healthUp)
+					}
+					continue
+				}
+				if target.Health != healthDown {
+					t.Errorf("target %s health = %s, want %s", name, target.Health, healthDown)
+				}
+				if !strings.Contains(target.LastError, tt.wantError) {
+					t.Errorf("target %s error = %q, want it to contain %q", name, target.LastError, tt.wantError)
+				}
+				if target.ErrorKind != tt.wantKind {
+					t.Errorf("target %s error kind = %q, want %q", name, target.ErrorKind, tt.wantKind)
+				}
+			}
+
+			// Queries still succeed and report the failed target as a warning
+			result, err := store.ExecutePromQL(context.Background(), "up")
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			want := "failed to collect metrics from " + tt.target
+			if len(result.Warnings) != 1 || !strings.HasPrefix(result.Warnings[0], want) {
+				t.Errorf("warnings = %v, want one starting with %q", result.Warnings, want)
+			}
+		})
+	}
+}
+
+func TestCollectAllMetricsTargetStatus(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	store := newTestStore(t)
+	client := cluster.client()
+	client.cluster = "prod"
+
+	if err := collectAllMetrics(context.Background(), store, client, false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+	targets := targetsByName(store)
+	address := strings.TrimPrefix(cluster.server.URL, "http://")
+
+	kubelet := targets["prod/kubelet"]
+	if want := cluster.server.URL + nodeProxyPath("node-a", "metrics"); kubelet.ScrapeURL != want {
+		t.Errorf("kubelet scrape URL = %q, want %q", kubelet.ScrapeURL, want)
+	}
+	wantLabels := map[string]string{"job": "kubelet", "instance": address, "cluster": "prod"}
+	if !maps.Equal(kubelet.Labels, wantLabels) {
+		t.Errorf("kubelet labels = %v, want %v", kubelet.Labels, wantLabels)
+	}
+	wantDiscovered := map[string]string{
+		"__address__":                 address,
+		"__scheme__":                  "http",
+		"__metrics_path__":            nodeProxyPath("node-a", "metrics"),
+		"__meta_kubernetes_node_name": "node-a",
+	}
+	if !maps.Equal(kubelet.DiscoveredLabels, wantDiscovered) {
+		t.Errorf("kubelet discovered labels = %v, want %v", kubelet.DiscoveredLabels, wantDiscovered)
+	}
+
+	scheduler := targets["prod/scheduler"]
+	if scheduler.DiscoveredLabels["__meta_kubernetes_pod_name"] != "kube-scheduler-node-a" ||
+		scheduler.DiscoveredLabels["__meta_kubernetes_namespace"] != "kube-system" {
+		t.Errorf("scheduler discovered labels = %v, want its pod", scheduler.DiscoveredLabels)
+	}
+
+	// Every sample scraped is a series of the store
+	samples := 0
+	for name, target := range targets {
+		if target.Samples == 0 {
+			t.Errorf("target %s has no samples", name)
+		}
+		samples += target.Samples
+	}
+	query := fmt.Sprintf(`count({__name__=~".+", __name__!=%q})`, retriesMetric)
+	if got := queryValues(t, store, query)["{}"]; got != float64(samples) {
+		t.Errorf("store has %v series, want the %d samples of the targets", got, samples)
+	}
+}
+
+func TestCollectAllMetricsNoNodes(t *testing.T) {
+	cluster := newFakeCluster(t)
+	store := newTestStore(t)
+
+	if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+
+	targets := targetsByName(store)
+	for _, name := range []string{"kubelet", "node"} {
+		if targets[name].LastError != "no nodes found" {
+			t.Errorf("target %s error = %q, want %q", name, targets[name].LastError, "no nodes found")
+		}
+	}
+	for _, path := range cluster.requested() {
+		if strings.Contains(path, "/proxy/") {
+			t.Errorf("unexpected proxy request %s without nodes or pods", path)
+		}
+	}
+}
+
+func TestCollectKubeletMetricsNamedNode(t *testing.T) {
+	cluster := newFakeCluster(t, fakeNode("node-a"), fakeNode("node-b"))
+	cluster.serveFixture(nodeProxyPath("node-b", "metrics"), "kubelet.prom")
+
+	result, err := collectKubeletMetrics(context.Background(), cluster.client(), "node-b")
+	if err != nil {
+		t.Fatalf("collectKubeletMetrics: %v", err)
+	}
+	if _, ok := result.families["kubelet_running_pods"]; !ok {
+		t.Errorf("kubelet_running_pods missing from %d families", len(result.families))
+	}
+
+	_, err = collectKubeletMetrics(context.Background(), cluster.client(), "node-c")
+	if err == nil || !strings.Contains(err.Error(), "getting node node-c") {
+		t.Errorf("error = %v, want getting node node-c", err)
+	}
+}
+
+func TestCollectPodMetricsNamespace(t *testing.T) {
+	cluster := newFakeCluster(t,
+		fakePod("kube-system", "kube-scheduler-node-a", map[string]string{"component": "kube-scheduler"}),
+		fakePod("control-plane", "kube-scheduler-node-b", map[string]string{"component": "kube-scheduler"}),
+	)
+	cluster.serveFixture(podProxyPath("control-plane", "kube-scheduler-node-b", 10259, "metrics"), "scheduler.prom")
+
+	client := cluster.client()
+	client.namespace = "control-plane"
+	if _, err := collectSchedulerMetrics(context.Background(), client, "scheduler"); err != nil {
+		t.Fatalf("collectSchedulerMetrics: %v", err)
+	}
+	if requests := cluster.requested(); slices.ContainsFunc(requests, func(path string) bool {
+		return strings.Contains(path, "/namespaces/kube-system/")
+	}) {
+		t.Errorf("requests %v went to kube-system, want only control-plane", requests)
+	}
+}
+
+func TestCollectAllMetricsDirect(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+
+	// Kubelet and pods answer on the addresses of the fake node and pods
+	fixtures := map[string]string{
+		"https://10.0.0.10:10250/metrics":          "kubelet.prom",
+		"https://10.0.0.10:10250/metrics/cadvisor": "cadvisor.prom",
+		"https://10.0.0.10:10259/metrics":          "scheduler.prom",
+		"https://10.0.0.10:10257/metrics":          "controller-manager.prom",
+	}
+	direct := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := fixtures["https://"+r.Host+r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", "fixtures", name))
+	}))
+	defer direct.Close()
+	httpClient := direct.Client()
+	transport := httpClient.Transport.(*http.Transport)
+	transport.TLSClientConfig.ServerName = "127.0.0.1"
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, network, direct.Listener.Addr().String())
+	}
+
+	client := cluster.client()
+	client.direct = httpClient
+	store := newTestStore(t)
+	if err := collectAllMetrics(context.Background(), store, client, false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+
+	for name, target := range targetsByName(store) {
+		if target.Health != healthUp {
+			t.Errorf("target %s health = %s (%s), want %s", name, target.Health, target.LastError, healthUp)
+		}
+	}
+	for _, path := range cluster.requested() {
+		if strings.Contains(path, "/proxy/") {
+			t.Errorf("requested %s through the API server proxy", path)
+		}
+	}
+}
+
+func TestCollectClusters(t *testing.T) {
+	staging := newStandardFakeCluster(t)
+	staging.serve("/metrics", http.StatusOK, []byte("apiserver_storage_objects{cluster=\"etcd-main\",resource=\"pods\"} 42\n"))
+	prod := newStandardFakeCluster(t)
+	prod.serveError(nodeProxyPath("node-a", "metrics"), http.StatusBadGateway)
+
+	stagingClient := staging.client()
+	stagingClient.cluster = "staging"
+	prodClient := prod.client()
+	prodClient.cluster = "prod"
+
+	store := newTestStore(t)
+	clients := []*clusterClient{stagingClient, prodClient}
+	if err := collectClusters(context.Background(), store, clients, false); err != nil {
+		t.Fatalf("collectClusters: %v", err)
+	}
+
+	targets := targetsByName(store)
+	if len(targets) != 10 {
+		t.Errorf("got %d targets, want 10", len(targets))
+	}
+	for name, target := range targets {
+		cluster, _, _ := strings.Cut(name, "/")
+		if target.Cluster != cluster {
+			t.Errorf("target %s cluster = %q, want %q", name, target.Cluster, cluster)
+		}
+	}
+	if target := targets["prod/kubelet"]; target.Health != healthDown {
+		t.Errorf("prod/kubelet health = %s, want %s", target.Health, healthDown)
+	}
+	if target := targets["staging/kubelet"]; target.Health != healthUp {
+		t.Errorf("staging/kubelet health = %s (%s), want %s", target.Health, target.LastError, healthUp)
+	}
+
+	tests := []struct {
+		query string
+		want  map[string]float64
+	}{
+		{
+			query: "sum by (cluster) (kubelet_running_pods)",
+			want:  map[string]float64{"{cluster=staging}": 12},
+		},
+		{
+			query: "sum by (cluster) (scheduler_pending_pods)",
+			want:  map[string]float64{"{cluster=prod}": 3, "{cluster=staging}": 3},
+		},
+		{
+			// Scraped cluster labels are kept as exported_cluster
+			query: "apiserver_storage_objects",
+			want:  map[string]float64{"{cluster=staging,exported_cluster=etcd-main,resource=pods}": 42},
+		},
+	}
+	for _, tt := range tests {
+		got := queryValues(t, store, tt.query)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for lbls, want := range tt.want {
+			if value, ok := got[lbls]; !ok || value != want {
+				t.Errorf("%s: %s = %v, want %v", tt.query, lbls, got[lbls], want)
+			}
+		}
+	}
+
+	result, err := store.ExecutePromQL(context.Background(), "up")
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(result.Warnings) != 1 || !strings.HasPrefix(result.Warnings[0], "failed to collect metrics from prod/kubelet") {
+		t.Errorf("warnings = %v, want one for prod/kubelet", result.Warnings)
+	}
+}
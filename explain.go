@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/util/stats"
+)
+
+// QueryExplanation describes how a PromQL query was parsed and evaluated
+type QueryExplanation struct {
+	*QueryResult `json:"-"`
+
+	Tree      string             `json:"tree"`
+	Selectors []SelectorStats    `json:"selectors"`
+	Stats     stats.BuiltinStats `json:"stats"`
+}
+
+// SelectorStats records how many series a selector matched in InMemoryQuerier.Select
+type SelectorStats struct {
+	Selector string `json:"selector"`
+	Series   int    `json:"series"`
+}
+
+// selectTrace collects selector statistics for a single query
+type selectTrace struct {
+	mutex     sync.Mutex
+	selectors []SelectorStats
+}
+
+type selectTraceKey struct{}
+
+// withSelectTrace returns a context that makes Select record its matches in trace
+func withSelectTrace(ctx context.Context, trace *selectTrace) context.Context {
+	return context.WithValue(ctx, selectTraceKey{}, trace)
+}
+
+// recordSelect stores the number of series matched by a selector if ctx is being traced
+func recordSelect(ctx context.Context, matchers []*labels.Matcher, series int) {
+	trace, ok := ctx.Value(selectTraceKey{}).(*selectTrace)
+	if !ok {
+		return
+	}
+
+	parts := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		parts = append(parts, m.String())
+	}
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	trace.selectors = append(trace.selectors, SelectorStats{
+		Selector: "{" + strings.Join(parts, ", ") + "}",
+		Series:   series,
+	})
+}
+
+// ExplainPromQLAt executes a PromQL query at ts and returns its results together
+// with the parsed expression tree, per-selector matches and engine statistics
+func (s *MetricStore) ExplainPromQLAt(ctx context.Context, query string, ts time.Time) (*QueryExplanation, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PromQL query: %w", err)
+	}
+
+	trace := &selectTrace{}
+	ctx = withSelectTrace(ctx, trace)
+
+	q, result, err := s.instantQuery(ctx, query, ts, promql.NewPrometheusQueryOpts(true, 0))
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	queryResult, err := s.newQueryResult(query, *result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryExplanation{
+		QueryResult: queryResult,
+		Tree:        parser.Tree(expr),
+		Selectors:   trace.selectors,
+		Stats:       stats.NewQueryStats(q.Stats()).Builtin(),
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestExplainPromQLAt(t *testing.T) {
+	store := newEngineTestStore(t, DefaultEngineOptions())
+	other := labels.FromStrings(labels.MetricName, "test_metric", "job", "other")
+	store.appendSample(other, testTime(9*time.Minute).UnixMilli(), 5)
+
+	tests := []struct {
+		name         string
+		query        string
+		wantResults  int
+		wantSelector string
+		wantSeries   int
+		wantTree     []string
+		wantSamples  int64
+	}{
+		{
+			name:         "selector",
+			query:        `test_metric{job="test"}`,
+			wantResults:  1,
+			wantSelector: `{job="test", __name__="test_metric"}`,
+			wantSeries:   1,
+			wantTree:     []string{"VectorSelector"},
+			wantSamples:  1,
+		},
+		{
+			name:         "aggregation",
+			query:        `sum by (job) (rate(test_metric[5m]))`,
+			wantResults:  1,
+			wantSelector: `{__name__="test_metric"}`,
+			wantSeries:   2,
+			wantTree:     []string{"AggregateExpr", "Call", "MatrixSelector", "VectorSelector"},
+			wantSamples:  21,
+		},
+	}
+	for _, tt := range tests {
+		explanation, err := store.ExplainPromQLAt(context.Background(), tt.query, testTime(10*time.Minute))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(explanation.Results) != tt.wantResults {
+			t.Errorf("%s: %d results, want %d", tt.name, len(explanation.Results), tt.wantResults)
+		}
+		if len(explanation.Selectors) != 1 || explanation.Selectors[0].Selector != tt.wantSelector || explanation.Selectors[0].Series != tt.wantSeries {
+			t.Errorf("%s: selectors %+v, want %s matching %d series", tt.name, explanation.Selectors, tt.wantSelector, tt.wantSeries)
+		}
+		for _, node := range tt.wantTree {
+			if !strings.Contains(explanation.Tree, node) {
+				t.Errorf("%s: tree has no %s:\n%s", tt.name, node, explanation.Tree)
+			}
+		}
+		if samples := explanation.Stats.Samples; samples == nil || samples.TotalQueryableSamples != tt.wantSamples {
+			t.Errorf("%s: stats samples %+v, want %d queryable samples", tt.name, samples, tt.wantSamples)
+		}
+	}
+}
+
+func TestExplainPromQLAtParseError(t *testing.T) {
+	store := newEngineTestStore(t, DefaultEngineOptions())
+
+	_, err := store.ExplainPromQLAt(context.Background(), "sum(test_metric", testTime(10*time.Minute))
+	if err == nil || !strings.Contains(err.Error(), "invalid PromQL query") {
+		t.Errorf("ExplainPromQLAt = %v, want an invalid PromQL query error", err)
+	}
+}
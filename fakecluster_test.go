@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeRoute is the canned response of a fake cluster route
+type fakeRoute struct {
+	status int
+	body   []byte
+
+	// failures is how many more requests fail with failStatus
+	failures   int
+	failStatus int
+}
+
+// fakeCluster imitates the parts of a cluster the collectors use: a fake
+// clientset for node and pod discovery, and an httptest server for the API
+// server's /metrics route and its node and pod proxy routes. The server also
+// answers node and pod requests from the fake clientset, so a real clientset
+// can be pointed at it.
+type fakeCluster struct {
+	t         *testing.T
+	server    *httptest.Server
+	clientset *fake.Clientset
+
+	mutex    sync.Mutex
+	routes   map[string]fakeRoute
+	requests []string
+}
+
+// newFakeCluster starts a fake cluster holding objects. It has no routes until
+// they are added with serveFixture or serveError.
+func newFakeCluster(t *testing.T, objects ...runtime.Object) *fakeCluster {
+	t.Helper()
+
+	f := &fakeCluster{
+		t:         t,
+		clientset: fake.NewSimpleClientset(objects...),
+		routes:    make(map[string]fakeRoute),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// newStandardFakeCluster starts a fake cluster with a single control-plane node
+// whose kubelet, cAdvisor, scheduler and controller-manager serve the recorded
+// fixtures in testdata/fixtures
+func newStandardFakeCluster(t *testing.T) *fakeCluster {
+	t.Helper()
+
+	f := newFakeCluster(t,
+		fakeNode("node-a"),
+		fakePod("kube-system", "kube-scheduler-node-a", map[string]string{"component": "kube-scheduler"}),
+		fakePod("kube-system", "kube-controller-manager-node-a", map[string]string{"component": "kube-controller-manager"}),
+	)
+	f.serveFixture("/metrics", "apiserver.prom")
+	f.serveFixture(nodeProxyPath("node-a", "metrics"), "kubelet.prom")
+	f.serveFixture(nodeProxyPath("node-a", "metrics/cadvisor"), "cadvisor.prom")
+	f.serveFixture(podProxyPath("kube-system", "kube-scheduler-node-a", 10259, "metrics"), "scheduler.prom")
+	f.serveFixture(podProxyPath("kube-system", "kube-controller-manager-node-a", 10257, "metrics"), "controller-manager.prom")
+	return f
+}
+
+// client returns a cluster client wired to the fake clientset and server
+func (f *fakeCluster) client() *clusterClient {
+	return &clusterClient{
+		clientset:  f.clientset,
+		httpClient: f.server.Client(),
+		host:       f.server.URL,
+	}
+}
+
+// serveFixture serves the exposition fixture testdata/fixtures/name on path
+func (f *fakeCluster) serveFixture(path, name string) {
+	f.t.Helper()
+
+	body, err := os.ReadFile(filepath.Join("testdata", "fixtures", name))
+	if err != nil {
+		f.t.Fatalf("reading fixture: %v", err)
+	}
+	f.serve(path, http.StatusOK, body)
+}
+
+// serveError makes path fail with status
+func (f *fakeCluster) serveError(path string, status int) {
+	f.serve(path, status, []byte(http.StatusText(status)))
+}
+
+// serveFlaky makes path fail with status the first failures times it is
+// requested, and serve the exposition fixture testdata/fixtures/name after
+func (f *fakeCluster) serveFlaky(path string, failures, status int, name string) {
+	f.t.Helper()
+
+	f.serveFixture(path, name)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	route := f.routes[path]
+	route.failures, route.failStatus = failures, status
+	f.routes[path] = route
+}
+
+// serve sets the response of path
+func (f *fakeCluster) serve(path string, status int, body []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.routes[path] = fakeRoute{status: status, body: body}
+}
+
+// requested returns the paths requested from the server so far
+func (f *fakeCluster) requested() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeCluster) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	f.requests = append(f.requests, r.URL.Path)
+	route, ok := f.routes[r.URL.Path]
+	if ok && route.failures > 0 {
+		f.routes[r.URL.Path] = fakeRoute{status: route.status, body: route.body, failures: route.failures - 1, failStatus: route.failStatus}
+		route = fakeRoute{status: route.failStatus, body: []byte(http.StatusText(route.failStatus))}
+	}
+	f.mutex.Unlock()
+
+	if !ok && f.serveDiscovery(w, r) {
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("the server could not find the requested resource (get %s)", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(route.status)
+	w.Write(route.body)
+}
+
+// serveDiscovery answers node and pod requests from the fake clientset and
+// reports whether r was one
+func (f *fakeCluster) serveDiscovery(w http.ResponseWriter, r *http.Request) bool {
+	ctx := r.Context()
+	opts := metav1.ListOptions{LabelSelector: r.URL.Query().Get("labelSelector")}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	var obj runtime.Object
+	var kind string
+	var err error
+	switch {
+	case len(parts) == 3 && parts[2] == "nodes":
+		obj, err = f.clientset.CoreV1().Nodes().List(ctx, opts)
+		kind = "NodeList"
+	case len(parts) == 4 && parts[2] == "nodes":
+		obj, err = f.clientset.CoreV1().Nodes().Get(ctx, parts[3], metav1.GetOptions{})
+		kind = "Node"
+	case len(parts) == 5 && parts[2] == "namespaces" && parts[4] == "pods":
+		obj, err = f.clientset.CoreV1().Pods(parts[3]).List(ctx, opts)
+		kind = "PodList"
+	default:
+		return false
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		var apiStatus apierrors.APIStatus
+		if !errors.As(err, &apiStatus) {
+			apiStatus = apierrors.NewInternalError(err)
+		}
+		result := apiStatus.Status()
+		obj, kind, status = &result, "Status", int(result.Code)
+	}
+	obj.GetObjectKind().SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind(kind))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+	return true
+}
+
+// fakeNode returns a ready node
+func fakeNode(name string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.10"}},
+		},
+	}
+}
+
+// fakePod returns a running pod with labels
+func fakePod(namespace, name string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.10"},
+	}
+}
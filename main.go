@@ -1,144 +1,704 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
-	"text/tabwriter"
 	"time"
 
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/spf13/pflag"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/util/homedir"
 )
 
-func main() {
-	var kubeconfig string
-	var insecureTLS bool
-	var debug bool
-	var query string
+// collectionTimeout bounds a single collection of metrics from the cluster
+const collectionTimeout = 30 * time.Second
 
-	// Set up command line flags
-	if home := homedir.HomeDir(); home != "" {
-		flag.StringVar(&kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), 
-			"(optional) absolute path to the kubeconfig file")
+// kubectlPlugin reports whether kubeprom was started by kubectl as the
+// kubectl-prom plugin, in which case it takes kubectl's connection flags
+var kubectlPlugin = strings.HasPrefix(filepath.Base(os.Args[0]), "kubectl-")
+
+// clusterFlags holds the connection flags shared by all commands
+type clusterFlags struct {
+	kubeconfig  string
+	insecureTLS bool
+	debug       bool
+
+	// direct scrapes kubelets and control-plane pods on their own addresses,
+	// verifying them with caFile or not at all with insecureTLS
+	direct bool
+	caFile string
+
+	// qps, burst, maxInFlight and maxResponseSize (in MiB) protect the API
+	// server from the requests of a collection
+	qps             float64
+	burst           int
+	maxInFlight     int
+	maxResponseSize int64
+
+	// scrapeAttempts, retryBackoff and targetAttempts set the retry
+	// policies of transient scrape failures
+	scrapeAttempts int
+	retryBackoff   time.Duration
+	targetAttempts string
+
+	// replay, when set, is a session archive collections run against
+	// instead of the cluster
+	replay string
+
+	// kubeContext selects a kubeconfig context instead of the current one
+	kubeContext string
+
+	// contexts and allContexts fan collection out to several kubeconfig
+	// contexts, adding a cluster label to every series
+	contexts    string
+	allContexts bool
+
+	// configFlags holds kubectl's connection flags, such as --namespace, --as
+	// and --token, when running as a kubectl plugin
+	configFlags *genericclioptions.ConfigFlags
+}
+
+// register adds the cluster connection flags to fs. As a kubectl plugin the
+// kubeconfig and context flags are left to kubectl's flags, added by parse.
+func (c *clusterFlags) register(fs *flag.FlagSet) {
+	if kubectlPlugin {
+		c.configFlags = genericclioptions.NewConfigFlags(false)
+		c.configFlags.KubeConfig = &c.kubeconfig
+		c.configFlags.Context = &c.kubeContext
+	} else if home := homedir.HomeDir(); home != "" {
+		fs.StringVar(&c.kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), 
+			"(optional) absolute path to the kubeconfig file; in-cluster credentials are used when it does not exist")
 	} else {
-		flag.StringVar(&kubeconfig, "kubeconfig", "", 
-			"absolute path to the kubeconfig file")
+		fs.StringVar(&c.kubeconfig, "kubeconfig", "", 
+			"absolute path to the kubeconfig file; in-cluster credentials are used when empty")
+	}
+	if !kubectlPlugin {
+		fs.StringVar(&c.kubeContext, "context", "",
+			"Kubeconfig context to use instead of the current context")
 	}
 	
-	flag.BoolVar(&insecureTLS, "insecure-tls", false, 
-		"Skip TLS certificate verification for component connections (use with caution)")
-	flag.BoolVar(&debug, "debug", false, 
+	fs.BoolVar(&c.direct, "direct", false,
+		"Scrape kubelets and control-plane pods on their node and pod IPs instead of through the API server proxy")
+	fs.StringVar(&c.caFile, "ca-file", "",
+		"CA bundle verifying kubelet and control-plane certificates with -direct (default: the cluster CA)")
+	fs.BoolVar(&c.insecureTLS, "insecure-tls", false, 
+		"Skip TLS certificate verification of kubelets and control-plane pods with -direct (use with caution)")
+	fs.Float64Var(&c.qps, "qps", defaultQPS,
+		"Maximum requests per second sent to the API server, including proxied scrapes, 0 for no limit")
+	fs.IntVar(&c.burst, "burst", defaultBurst,
+		"Maximum burst of requests sent to the API server above -qps, at least 1 when -qps is set")
+	fs.IntVar(&c.maxInFlight, "max-in-flight", defaultMaxInFlight,
+		"Maximum scrapes through the API server in flight at once, at least 1")
+	fs.Int64Var(&c.maxResponseSize, "max-response-size", defaultMaxResponseSize,
+		"Maximum size in MiB of a scrape response, 0 for no limit; must not be negative")
+	fs.IntVar(&c.scrapeAttempts, "scrape-attempts", defaultScrapeAttempts,
+		"Attempts at scraping a component, retrying transient failures such as 503s, resets and timeouts")
+	fs.DurationVar(&c.retryBackoff, "retry-backoff", defaultRetryBackoff,
+		"Backoff before the first retry of a scrape, doubling with every retry, with jitter")
+	fs.StringVar(&c.targetAttempts, "target-attempts", "",
+		"Comma-separated component=attempts overriding -scrape-attempts, such as kubelet=5,scheduler=1")
+	fs.BoolVar(&c.debug, "debug", false, 
 		"Show debug information")
-	flag.StringVar(&query, "query", "", 
-		"PromQL query to execute (required)")
+	fs.StringVar(&c.replay, "replay", "",
+		"Session archive written by the record command to collect from instead of the cluster")
+	fs.StringVar(&c.contexts, "contexts", "",
+		"Comma-separated kubeconfig contexts to collect from concurrently, labelling series with cluster")
+	fs.BoolVar(&c.allContexts, "all-contexts", false,
+		"Collect from every kubeconfig context concurrently, labelling series with cluster")
+}
+
+// parse parses args into fs. As a kubectl plugin, args are parsed kubectl
+// style, with double-dash flags, together with kubectl's connection flags.
+func (c *clusterFlags) parse(fs *flag.FlagSet, args []string) {
+	if c.configFlags == nil {
+		fs.Parse(args)
+		return
+	}
+
+	kubectlFlags := pflag.NewFlagSet("kubectl", pflag.ExitOnError)
+	c.configFlags.AddFlags(kubectlFlags)
+	commandFlags := pflag.NewFlagSet(fs.Name(), pflag.ExitOnError)
+	commandFlags.AddGoFlagSet(fs)
+	commandFlags.VisitAll(func(f *pflag.Flag) { f.Usage = kubectlStyle(f.Usage) })
+
+	pfs := pflag.NewFlagSet(fs.Name(), pflag.ExitOnError)
+	pfs.AddFlagSet(kubectlFlags)
+	pfs.AddGoFlagSet(fs)
+
+	// The command's own usage lists its flags Go style, with one dash, which
+	// pflag rejects, so only its text is kept and the flags are listed by
+	// pflag. fs.Usage is replaced too, for commands showing it on errors.
+	usage := fs.Usage
+	fs.Usage = func() {
+		out := fs.Output()
+		var text bytes.Buffer
+		fs.SetOutput(&text)
+		usage()
+		fs.SetOutput(out)
+
+		description, _, _ := strings.Cut(text.String(), "Options:\n")
+		fmt.Fprint(out, kubectlStyle(description))
+		fmt.Fprintf(out, "Options:\n%s\nKubectl options:\n%s", commandFlags.FlagUsages(), kubectlFlags.FlagUsages())
+	}
+	pfs.Usage = fs.Usage
+	pfs.Parse(args)
+}
+
+// goStyleFlag matches a flag written Go style, such as -query, at the start of
+// a word
+var goStyleFlag = regexp.MustCompile(`(^|[\s'"(\[])-([a-z][a-z0-9]*(?:-[a-z0-9]+)*)\b`)
+
+// kubectlStyle rewrites usage text for the kubectl plugin: the program is
+// called as kubectl prom and flags are written with two dashes
+func kubectlStyle(text string) string {
+	text = strings.ReplaceAll(text, os.Args[0], "kubectl prom")
+	return goStyleFlag.ReplaceAllString(text, "$1--$2")
+}
+
+// namespace returns the namespace given by --namespace, in which control-plane
+// pods are discovered instead of kube-system
+func (c *clusterFlags) namespace() string {
+	if c.configFlags == nil {
+		return ""
+	}
+	return *c.configFlags.Namespace
+}
+
+// restConfig builds the Kubernetes client configuration from the kubeconfig,
+// falling back to the pod's ServiceAccount credentials when running in a
+// cluster without one and no context was asked for
+func (c *clusterFlags) restConfig() (*rest.Config, error) {
+	if c.configFlags != nil {
+		return c.configFlags.ToRESTConfig()
+	}
+
+	_, err := os.Stat(c.kubeconfig)
+	if c.kubeContext == "" && (c.kubeconfig == "" || errors.Is(err, os.ErrNotExist)) {
+		config, inClusterErr := rest.InClusterConfig()
+		if inClusterErr == nil {
+			if c.debug {
+				fmt.Printf("Debug: Using in-cluster ServiceAccount credentials for %s\n", config.Host)
+			}
+			return config, nil
+		}
+		if c.kubeconfig == "" {
+			return nil, inClusterErr
+		}
+		return nil, fmt.Errorf("kubeconfig %s not found and not running in a cluster: %w", c.kubeconfig, inClusterErr)
+	}
+	return c.contextConfig(c.kubeContext)
+}
+
+// contextConfig builds the client configuration of a kubeconfig context, or
+// of the current context when name is empty
+func (c *clusterFlags) contextConfig(name string) (*rest.Config, error) {
+	if c.configFlags != nil {
+		// The kubectl flags are bound to kubeContext
+		current := c.kubeContext
+		defer func() { c.kubeContext = current }()
+		c.kubeContext = name
+		return c.configFlags.ToRESTConfig()
+	}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: c.kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: name},
+	).ClientConfig()
+}
+
+// contextNames returns the contexts given by -contexts or -all-contexts, or
+// nil when collecting from a single cluster
+func (c *clusterFlags) contextNames() ([]string, error) {
+	if c.allContexts {
+		config, err := c.rawConfig()
+		if err != nil {
+			return nil, fmt.Errorf("loading kubeconfig: %w", err)
+		}
+		if len(config.Contexts) == 0 {
+			return nil, fmt.Errorf("kubeconfig has no contexts")
+		}
+		return sortedKeys(config.Contexts), nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(c.contexts, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// newClient creates the client of the cluster described by config, throttling
+// the requests sent to the API server and adding a client for direct
+// connections to the components with -direct
+func (c *clusterFlags) newClient(config *rest.Config) (*clusterClient, error) {
+	retries, err := parseRetryPolicies(c.scrapeAttempts, c.retryBackoff, c.targetAttempts)
+	if err != nil {
+		return nil, err
+	}
+	// A token bucket without room for one token never lets a request through
+	if c.qps > 0 && c.burst < 1 {
+		return nil, fmt.Errorf("-burst must be at least 1 when -qps is set, got %d", c.burst)
+	}
+	if c.maxInFlight < 1 {
+		return nil, fmt.Errorf("-max-in-flight must be at least 1, got %d", c.maxInFlight)
+	}
+	if c.maxResponseSize < 0 {
+		return nil, fmt.Errorf("-max-response-size must not be negative, got %d", c.maxResponseSize)
+	}
+	throttle := newAPIThrottle(float32(c.qps), c.burst, c.maxInFlight)
+	config.RateLimiter = throttle.limiter
+
+	client, err := newClusterClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.retries = retries
+	client.httpClient = &http.Client{
+		Transport: throttle.wrap(client.httpClient.Transport),
+		Timeout:   client.httpClient.Timeout,
+	}
+	client.namespace = c.namespace()
+	client.maxResponseSize = c.maxResponseSize << 20
+	if !c.direct {
+		return client, nil
+	}
+
+	if config.Impersonate.UserName != "" || len(config.Impersonate.Groups) > 0 {
+		return nil, fmt.Errorf("impersonation only applies through the API server and cannot be used with -direct")
+	}
+	client.direct, err = rest.HTTPClientFor(c.directConfig(config))
+	if err != nil {
+		return nil, fmt.Errorf("creating direct HTTP client: %v", err)
+	}
+	return client, nil
+}
+
+// directConfig derives the configuration of direct component connections
+// from the API server's: the same credentials, such as the ServiceAccount
+// token, checking certificates against -ca-file or the cluster CA, or not at
+// all with -insecure-tls
+func (c *clusterFlags) directConfig(config *rest.Config) *rest.Config {
+	direct := rest.CopyConfig(config)
+	direct.TLSClientConfig.ServerName = ""
+	switch {
+	case c.insecureTLS:
+		direct.TLSClientConfig.Insecure = true
+		direct.TLSClientConfig.CAFile = ""
+		direct.TLSClientConfig.CAData = nil
+	case c.caFile != "":
+		direct.TLSClientConfig.CAFile = c.caFile
+		direct.TLSClientConfig.CAData = nil
+	}
+	return direct
+}
+
+// rawConfig loads the kubeconfig, merging the files of $KUBECONFIG as kubectl
+// does when running as a kubectl plugin
+func (c *clusterFlags) rawConfig() (*clientcmdapi.Config, error) {
+	if c.configFlags != nil {
+		config, err := c.configFlags.ToRawKubeConfigLoader().RawConfig()
+		return &config, err
+	}
+	return clientcmd.LoadFromFile(c.kubeconfig)
+}
+
+// collect builds the clients of the flags and collects their metrics once
+// into a new store with the engine settings opts. The caller must close the
+// store.
+func (c *clusterFlags) collect(opts EngineOptions) (*MetricStore, error) {
+	clients, err := c.clients()
+	if err != nil {
+		return nil, err
+	}
+	return collectOnce(clients, opts, c.debug)
+}
+
+// clients builds the clients of every cluster to collect from: a replayed
+// session, each context of -contexts or -all-contexts, or otherwise the
+// single cluster of the kubeconfig or of the pod
+func (c *clusterFlags) clients() ([]*clusterClient, error) {
+	names, err := c.contextNames()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 && (c.kubeContext != "" || c.replay != "") {
+		return nil, fmt.Errorf("-contexts and -all-contexts cannot be combined with -context or -replay")
+	}
+	if c.direct && c.replay != "" {
+		return nil, fmt.Errorf("-direct cannot be combined with -replay")
+	}
+	if !c.direct && (c.insecureTLS || c.caFile != "") {
+		fmt.Fprintf(os.Stderr, "Warning: -insecure-tls and -ca-file only apply to -direct; components are reached through the API server proxy\n")
+	}
+
+	if c.replay != "" {
+		s, err := readSession(c.replay)
+		if err != nil {
+			return nil, err
+		}
+		if c.debug {
+			fmt.Printf("Debug: Replaying %d responses from %s, recorded at %s\n",
+				len(s.Entries), s.Host, s.RecordedAt.Format(time.RFC3339))
+		}
+		client, err := s.client()
+		if err != nil {
+			return nil, err
+		}
+		return []*clusterClient{client}, nil
+	}
+
+	if len(names) == 0 {
+		config, err := c.restConfig()
+		if err != nil {
+			return nil, fmt.Errorf("building kubeconfig: %w", err)
+		}
+		client, err := c.newClient(config)
+		if err != nil {
+			return nil, err
+		}
+		return []*clusterClient{client}, nil
+	}
+
+	clients := make([]*clusterClient, 0, len(names))
+	for _, name := range names {
+		config, err := c.contextConfig(name)
+		if err != nil {
+			return nil, fmt.Errorf("building config for context %s: %w", name, err)
+		}
+		client, err := c.newClient(config)
+		if err != nil {
+			return nil, fmt.Errorf("context %s: %w", name, err)
+		}
+		client.cluster = name
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// printUsage writes the usage of the query command, whose flags are in fs
+func printUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(fs.Output(), "Usage: %s [OPTIONS] -query <promql_query>\n", os.Args[0])
+	fmt.Fprintf(fs.Output(), "       %s <command> [OPTIONS]\n\n", os.Args[0])
+	fmt.Fprintf(fs.Output(), "kubeprom - Kubernetes Native Metrics with PromQL\n\n")
+	fmt.Fprintf(fs.Output(), "Commands:\n")
+	fmt.Fprintf(fs.Output(), "  shell        Interactive PromQL shell over collected metrics\n")
+	fmt.Fprintf(fs.Output(), "  metrics      List collected metrics with their type, series and labels\n")
+	fmt.Fprintf(fs.Output(), "  cardinality  Report the metrics and labels with the most series\n")
+	fmt.Fprintf(fs.Output(), "  targets      Report the scrape health of every discovered target\n")
+	fmt.Fprintf(fs.Output(), "  alerts       Evaluate alerting rules and list pending and firing alerts\n")
+	fmt.Fprintf(fs.Output(), "  test rules   Run rule unit tests written for promtool test rules\n")
+	fmt.Fprintf(fs.Output(), "  serve        Collect periodically and serve the Prometheus HTTP API\n")
+	fmt.Fprintf(fs.Output(), "  record       Record the responses of a collection for -replay\n\n")
+	fmt.Fprintf(fs.Output(), "Examples:\n")
+	fmt.Fprintf(fs.Output(), "  %s -query \"kubelet_running_pods\"\n", os.Args[0])
+	fmt.Fprintf(fs.Output(), "  %s -query \"rate(apiserver_request_total[5m])\"\n", os.Args[0])
+	fmt.Fprintf(fs.Output(), "  %s -query \"container_memory_usage_bytes\" -direct -insecure-tls\n", os.Args[0])
+	fmt.Fprintf(fs.Output(), "  %s -query \"kubelet_running_pods\" -time +4m -lookback-delta 5m\n", os.Args[0])
+	fmt.Fprintf(fs.Output(), "  %s -query \"kubelet_running_pods\" -query \"kubelet_running_containers\"\n", os.Args[0])
+	fmt.Fprintf(fs.Output(), "  %s -query-file queries.yaml -output json\n\n", os.Args[0])
+	fmt.Fprintf(fs.Output(), "Options:\n")
+	fs.PrintDefaults()
+}
 
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] -query <promql_query>\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "kubeprom - Kubernetes Native Metrics with PromQL\n\n")
-		fmt.Fprintf(os.Stderr, "Examples:\n")
-		fmt.Fprintf(os.Stderr, "  %s -query \"kubelet_running_pods\"\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s -query \"rate(apiserver_request_total[5m])\"\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s -query \"container_memory_usage_bytes\" -insecure-tls\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
+func main() {
+	// Run a subcommand when one is given, otherwise execute queries
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "shell":
+			runShell(os.Args[2:])
+			return
+		case "metrics":
+			runMetrics(os.Args[2:])
+			return
+		case "cardinality":
+			runCardinality(os.Args[2:])
+			return
+		case "alerts":
+			runAlerts(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "test":
+			runTest(os.Args[2:])
+			return
+		case "record":
+			runRecord(os.Args[2:])
+			return
+		case "targets":
+			runTargets(os.Args[2:])
+			return
+		}
 	}
 
-	flag.Parse()
+	var cluster clusterFlags
+	var evalTime string
+	var queries queryFlags
+	var queryFile string
+	var rulesPattern string
+	cfg := queryConfig{engineOpts: DefaultEngineOptions()}
+
+	// Set up command line flags
+	cluster.register(flag.CommandLine)
+	flag.Var(&queries, "query", 
+		"PromQL query to execute (repeatable; required unless -query-file is set)")
+	flag.StringVar(&queryFile, "query-file", "", 
+		"File with named queries to execute (YAML, or plain text with one query per line)")
+	flag.StringVar(&evalTime, "time", "", 
+		"Evaluation time as RFC3339, unix timestamp, or relative to the end of collection like +1m (default: end of collection)")
+	flag.BoolVar(&cfg.explain, "explain", false, 
+		"Show the parsed query, selector matches and engine statistics")
+	flag.BoolVar(&cfg.explain, "stats", false, 
+		"Alias for -explain")
+	flag.StringVar(&cfg.output, "output", outputTable, 
+		"Output format: table or json")
+	flag.StringVar(&rulesPattern, "rules", "", 
+		"Prometheus rule file, or glob of rule files, whose recording and alerting rules are evaluated after collection")
+	addEngineFlags(flag.CommandLine, &cfg.engineOpts)
+
+	flag.Usage = func() { printUsage(flag.CommandLine) }
+
+	cluster.parse(flag.CommandLine, os.Args[1:])
+
+	// Gather queries from the command line and the query file
+	cfg.queries = queries.namedQueries()
+	if queryFile != "" {
+		fileQueries, err := loadQueryFile(queryFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.queries = append(cfg.queries, fileQueries...)
+	}
+	if err := checkQueryNames(cfg.queries); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Validate required query parameter
-	if query == "" {
-		fmt.Fprintf(os.Stderr, "Error: -query parameter is required\n\n")
-		flag.Usage()
+	if len(cfg.queries) == 0 && queryFile != "" {
+		fmt.Fprintf(os.Stderr, "Error: query file %s has no queries\n", queryFile)
+		os.Exit(1)
+	}
+	if len(cfg.queries) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: -query or -query-file parameter is required\n\n")
+		flag.CommandLine.Usage()
+		os.Exit(1)
+	}
+
+	if err := validateOutputFormat(cfg.output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		flag.CommandLine.Usage()
+		os.Exit(1)
+	}
+	if err := applyEngineFlags(cfg.engineOpts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		flag.CommandLine.Usage()
 		os.Exit(1)
 	}
 
-	// Build Kubernetes configuration
-	kubeConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	// Load recording rules before spending time on collection
+	ruleGroups, err := loadRules(rulesPattern)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error building kubeconfig: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.ruleGroups = ruleGroups
+
+	// Check the evaluation time now; it is resolved once collection completes
+	if _, err := parseEvalTime(evalTime, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -time value: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.evalTime = evalTime
+
+	// Build Kubernetes clients
+	clients, err := cluster.clients()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), collectionTimeout)
 	defer cancel()
 
-	// Execute the PromQL query
-	if err := executePromQLQuery(ctx, kubeConfig, query, insecureTLS, debug); err != nil {
+	// Execute the PromQL queries
+	if err := executePromQLQuery(ctx, clients, cfg, cluster.debug); err != nil {
 		fmt.Fprintf(os.Stderr, "Error executing query: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-// executePromQLQuery handles the main PromQL query execution workflow
-func executePromQLQuery(ctx context.Context, kubeConfig interface{}, query string, insecureTLS, debug bool) error {
-	if debug {
-		fmt.Printf("Debug: Executing PromQL query: %s\n", query)
+// addEngineFlags registers the PromQL engine tuning flags on fs
+func addEngineFlags(fs *flag.FlagSet, opts *EngineOptions) {
+	fs.DurationVar(&opts.LookbackDelta, "lookback-delta", opts.LookbackDelta, 
+		"Maximum lookback duration for retrieving metrics during expression evaluation")
+	fs.IntVar(&opts.MaxSamples, "max-samples", opts.MaxSamples, 
+		"Maximum number of samples a single query can load into memory")
+	fs.DurationVar(&opts.Timeout, "query-timeout", opts.Timeout, 
+		"Maximum time a query may take before being aborted")
+	fs.BoolVar(&opts.EnableAtModifier, "enable-at-modifier", opts.EnableAtModifier, 
+		"Enable the @ modifier in PromQL")
+	fs.BoolVar(&opts.EnableNegativeOffset, "enable-negative-offset", opts.EnableNegativeOffset, 
+		"Enable negative offsets in PromQL")
+	fs.BoolVar(&opts.EnableExperimentalFunctions, "enable-experimental-functions", opts.EnableExperimentalFunctions, 
+		"Enable experimental PromQL functions")
+	fs.StringVar(&opts.QueryLogFile, "query-log-file", opts.QueryLogFile, 
+		"File to which all executed queries are logged as JSON")
+	fs.StringVar(&opts.ActiveQueryDir, "active-query-dir", opts.ActiveQueryDir, 
+		"Directory used to track active queries (disabled if empty)")
+	fs.IntVar(&opts.MaxConcurrentQueries, "query-max-concurrency", opts.MaxConcurrentQueries, 
+		"Maximum number of queries executed concurrently when -active-query-dir is set")
+}
+
+// applyEngineFlags validates the engine flags and applies those the PromQL
+// parser holds for the whole process. Experimental functions are gated by the
+// parser, not the engine, so they are enabled here once rather than by every
+// metric store.
+func applyEngineFlags(opts EngineOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	parser.EnableExperimentalFunctions = opts.EnableExperimentalFunctions
+	return nil
+}
+
+// parseEvalTime parses the -time flag. It accepts an RFC3339 timestamp, a unix
+// timestamp in seconds, or a duration relative to now such as -2m or +30s.
+func parseEvalTime(value string, now time.Time) (time.Time, error) {
+	if value == "" || value == "now" {
+		return now, nil
+	}
+
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		d, err := model.ParseDuration(value[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing relative time %q: %w", value, err)
+		}
+		if value[0] == '-' {
+			return now.Add(-time.Duration(d)), nil
+		}
+		return now.Add(time.Duration(d)), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*1e9)), nil
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse %q as RFC3339, unix timestamp or relative duration", value)
+}
+
+// queryConfig holds the settings of a query run
+type queryConfig struct {
+	queries    []NamedQuery
+	evalTime   string // -time value, resolved when collection completes
+	explain    bool
+	output     string
+	engineOpts EngineOptions
+	ruleGroups []*ruleGroup
+}
+
+// executePromQLQuery handles the main PromQL query execution workflow. All
+// queries are evaluated against a single collection of metrics.
+func executePromQLQuery(ctx context.Context, clients []*clusterClient, cfg queryConfig, debug bool) error {
+	// Reject invalid queries before spending time on collection
+	for _, query := range cfg.queries {
+		if _, err := parser.ParseExpr(query.Query); err != nil {
+			return fmt.Errorf("invalid PromQL query %q: %w", query.Name, err)
+		}
 	}
 
 	// Create the metric store
-	store := NewMetricStore()
+	store, err := NewMetricStore(cfg.engineOpts)
+	if err != nil {
+		return fmt.Errorf("failed to create metric store: %w", err)
+	}
+	defer store.Close()
 
 	// Collect metrics from all available components
-	fmt.Println("Collecting metrics from Kubernetes components...")
-	if err := collectAllMetrics(ctx, store, kubeConfig, insecureTLS, debug); err != nil {
+	fmt.Fprintln(os.Stderr, "Collecting metrics from Kubernetes components...")
+	if err := collectClusters(ctx, store, clients, debug); err != nil {
 		return fmt.Errorf("failed to collect metrics: %w", err)
 	}
 
-	// Execute the PromQL query
-	results, err := store.ExecutePromQL(ctx, query)
+	outputs, err := evaluateQueries(ctx, store, cfg, debug)
 	if err != nil {
-		return fmt.Errorf("query execution failed: %w", err)
+		return err
 	}
 
-	// Display results in tabular format
-	displayResults(query, results)
-	return nil
+	// Display results in the requested format
+	return displayQueryResults(cfg.output, outputs)
 }
 
-// displayResults outputs the query results in a formatted table
-func displayResults(query string, results []MetricResult) {
-	fmt.Printf("\nQuery: %s\n", query)
-	fmt.Printf("Results: %d metrics found\n\n", len(results))
-
-	if len(results) == 0 {
-		fmt.Println("No metrics found matching the query.")
-		return
+// evaluateQueries evaluates the rules and then the queries of cfg against the
+// collected metrics. Every sample is stamped when it is scraped, so the
+// default, "now" and relative evaluation times are resolved once collection
+// has completed, and rules and queries are evaluated at that same instant.
+func evaluateQueries(ctx context.Context, store *MetricStore, cfg queryConfig, debug bool) ([]queryOutput, error) {
+	ts, err := parseEvalTime(cfg.evalTime, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid -time value: %w", err)
 	}
 
-	// Create tabwriter for aligned output
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	defer w.Flush()
+	// Record rule results so queries can use them
+	if err := store.EvaluateRules(ctx, cfg.ruleGroups, ts); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to evaluate rules: %v\n", err)
+	}
 
-	// Print header
-	fmt.Fprintln(w, "METRIC\tLABELS\tVALUE\tTIMESTAMP")
-	fmt.Fprintln(w, "------\t------\t-----\t---------")
+	outputs := make([]queryOutput, 0, len(cfg.queries))
+	for _, query := range cfg.queries {
+		if debug {
+			fmt.Printf("Debug: Executing PromQL query %q: %s at %s\n", query.Name, query.Query, ts.Format(time.RFC3339))
+		}
 
-	// Print results
-	for _, result := range results {
-		metricName := result.MetricName
-		
-		// Build label string (excluding __name__)
-		var labelPairs []string
-		for k, v := range result.Labels {
-			if k != "__name__" {
-				labelPairs = append(labelPairs, fmt.Sprintf("%s=%s", k, v))
-			}
+		output, err := runQuery(ctx, store, query, cfg.explain, ts)
+		if err != nil {
+			return nil, fmt.Errorf("query %q failed: %w", query.Name, err)
 		}
-		labelStr := strings.Join(labelPairs, ",")
-		if labelStr == "" {
-			labelStr = "{}"
-		} else {
-			labelStr = "{" + labelStr + "}"
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// runQuery executes a named query at ts, collecting engine statistics when
+// explaining
+func runQuery(ctx context.Context, store *MetricStore, query NamedQuery, explain bool, ts time.Time) (queryOutput, error) {
+	if explain {
+		explanation, err := store.ExplainPromQLAt(ctx, query.Query, ts)
+		if err != nil {
+			return queryOutput{}, err
 		}
+		explanation.Name = query.Name
+		return queryOutput{QueryResult: explanation.QueryResult, Explain: explanation}, nil
+	}
 
-		timestamp := time.UnixMilli(result.Timestamp).Format("15:04:05")
-		
-		fmt.Fprintf(w, "%s\t%s\t%.6f\t%s\n", 
-			metricName, labelStr, result.Value, timestamp)
+	result, err := store.ExecutePromQLAt(ctx, query.Query, ts)
+	if err != nil {
+		return queryOutput{}, err
 	}
-}
\ No newline at end of file
+	result.Name = query.Name
+	return queryOutput{QueryResult: result}, nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+func TestRestConfigOutOfCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	cluster := clusterFlags{kubeconfig: "/nonexistent/kubeconfig"}
+	_, err := cluster.restConfig()
+	if err == nil {
+		t.Fatal("restConfig succeeded without a kubeconfig or in-cluster credentials")
+	}
+	want := "kubeconfig /nonexistent/kubeconfig not found and not running in a cluster"
+	if got := err.Error(); !strings.HasPrefix(got, want) {
+		t.Errorf("error = %q, want it to start with %q", got, want)
+	}
+}
+
+// writeKubeconfig writes a kubeconfig with a staging and a prod context,
+// staging being the current one, and returns its path
+func writeKubeconfig(t *testing.T) string {
+	t.Helper()
+
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	config := `apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example:6443
+- name: staging
+  cluster:
+    server: https://staging.example:6443
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: admin
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+`
+	if err := os.WriteFile(kubeconfig, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return kubeconfig
+}
+
+func TestClusterFlagsContexts(t *testing.T) {
+	kubeconfig := writeKubeconfig(t)
+
+	tests := []struct {
+		name  string
+		flags clusterFlags
+		want  map[string]string // cluster name to host
+	}{
+		{
+			name:  "current context",
+			flags: clusterFlags{maxInFlight: defaultMaxInFlight, kubeconfig: kubeconfig},
+			want:  map[string]string{"": "https://staging.example:6443"},
+		},
+		{
+			name:  "selected context",
+			flags: clusterFlags{maxInFlight: defaultMaxInFlight, kubeconfig: kubeconfig, kubeContext: "prod"},
+			want:  map[string]string{"": "https://prod.example:6443"},
+		},
+		{
+			name:  "listed contexts",
+			flags: clusterFlags{maxInFlight: defaultMaxInFlight, kubeconfig: kubeconfig, contexts: "prod, staging"},
+			want:  map[string]string{"prod": "https://prod.example:6443", "staging": "https://staging.example:6443"},
+		},
+		{
+			name:  "all contexts",
+			flags: clusterFlags{maxInFlight: defaultMaxInFlight, kubeconfig: kubeconfig, allContexts: true},
+			want:  map[string]string{"prod": "https://prod.example:6443", "staging": "https://staging.example:6443"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients, err := tt.flags.clients()
+			if err != nil {
+				t.Fatalf("clients: %v", err)
+			}
+			got := make(map[string]string, len(clients))
+			for _, client := range clients {
+				got[client.cluster] = client.host
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("clients = %v, want %v", got, tt.want)
+			}
+			for cluster, host := range tt.want {
+				if got[cluster] != host {
+					t.Errorf("cluster %q host = %q, want %q", cluster, got[cluster], host)
+				}
+			}
+		})
+	}
+
+	flags := clusterFlags{maxInFlight: defaultMaxInFlight, kubeconfig: kubeconfig, kubeContext: "prod", allContexts: true}
+	if _, err := flags.clients(); err == nil {
+		t.Error("clients accepted -context together with -all-contexts")
+	}
+	flags = clusterFlags{maxInFlight: defaultMaxInFlight, kubeconfig: kubeconfig, contexts: "missing"}
+	if _, err := flags.clients(); err == nil || !strings.Contains(err.Error(), "context missing") {
+		t.Errorf("error = %v, want one naming context missing", err)
+	}
+}
+
+func TestKubectlPluginFlags(t *testing.T) {
+	kubeconfig := writeKubeconfig(t)
+	defer func(plugin bool) { kubectlPlugin = plugin }(kubectlPlugin)
+	kubectlPlugin = true
+
+	fs := flag.NewFlagSet("metrics", flag.ContinueOnError)
+	var cluster clusterFlags
+	cluster.register(fs)
+	cluster.parse(fs, []string{
+		"--kubeconfig", kubeconfig, "--context", "prod", "-n", "control-plane",
+		"--as", "jane", "--as-group", "viewers", "--as-group", "auditors",
+		"--token", "t0ken", "--request-timeout", "5s", "--debug",
+	})
+
+	config, err := cluster.restConfig()
+	if err != nil {
+		t.Fatalf("restConfig: %v", err)
+	}
+	if config.Host != "https://prod.example:6443" {
+		t.Errorf("host = %q, want the prod cluster", config.Host)
+	}
+	if config.Impersonate.UserName != "jane" {
+		t.Errorf("impersonated user = %q, want jane", config.Impersonate.UserName)
+	}
+	if want := []string{"viewers", "auditors"}; !slices.Equal(config.Impersonate.Groups, want) {
+		t.Errorf("impersonated groups = %v, want %v", config.Impersonate.Groups, want)
+	}
+	if config.BearerToken != "t0ken" {
+		t.Errorf("token = %q, want t0ken", config.BearerToken)
+	}
+	if config.Timeout != 5*time.Second {
+		t.Errorf("timeout = %v, want 5s", config.Timeout)
+	}
+	if !cluster.debug {
+		t.Error("--debug was not parsed")
+	}
+
+	clients, err := cluster.clients()
+	if err != nil {
+		t.Fatalf("clients: %v", err)
+	}
+	if len(clients) != 1 || clients[0].namespace != "control-plane" {
+		t.Errorf("clients = %+v, want one discovering pods in control-plane", clients)
+	}
+
+	// Every context of a fan-out keeps the kubectl flags
+	fs = flag.NewFlagSet("metrics", flag.ContinueOnError)
+	cluster = clusterFlags{}
+	cluster.register(fs)
+	cluster.parse(fs, []string{"--kubeconfig", kubeconfig, "--all-contexts", "--as", "jane"})
+	names, err := cluster.contextNames()
+	if err != nil {
+		t.Fatalf("contextNames: %v", err)
+	}
+	if want := []string{"prod", "staging"}; !slices.Equal(names, want) {
+		t.Fatalf("contexts = %v, want %v", names, want)
+	}
+	for _, name := range names {
+		config, err := cluster.contextConfig(name)
+		if err != nil {
+			t.Fatalf("contextConfig(%s): %v", name, err)
+		}
+		if want := "https://" + name + ".example:6443"; config.Host != want || config.Impersonate.UserName != "jane" {
+			t.Errorf("context %s: host %q as %q, want %q as jane", name, config.Host, config.Impersonate.UserName, want)
+		}
+	}
+}
+
+func TestKubectlPluginUsage(t *testing.T) {
+	defer func(plugin bool) { kubectlPlugin = plugin }(kubectlPlugin)
+	kubectlPlugin = true
+
+	fs := flag.NewFlagSet("kubectl-prom", flag.ContinueOnError)
+	var cluster clusterFlags
+	cluster.register(fs)
+	fs.String("query-file", "", "File with named queries, used instead of -query")
+	fs.Usage = func() { printUsage(fs) }
+	var out bytes.Buffer
+	fs.SetOutput(&out)
+	cluster.parse(fs, nil)
+
+	fs.Usage()
+	usage := out.String()
+	for _, want := range []string{
+		"Usage: kubectl prom [OPTIONS] --query <promql_query>",
+		"kubectl prom --query-file queries.yaml --output json",
+		"--query-file string",
+		"used instead of --query",
+		"Kubectl options:",
+		"--kubeconfig string",
+	} {
+		if !strings.Contains(usage, want) {
+			t.Errorf("usage does not contain %q:\n%s", want, usage)
+		}
+	}
+	singleDash := regexp.MustCompile(`(^|[\s'"(\[])-[a-z][a-z0-9-]+`)
+	for _, line := range strings.Split(usage, "\n") {
+		if match := singleDash.FindString(line); match != "" {
+			t.Errorf("usage line %q has the single-dash flag %q", line, strings.TrimSpace(match))
+		}
+	}
+}
+
+func TestClusterFlagsDirect(t *testing.T) {
+	var authorization string
+	kubelet := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("kubelet_running_pods 3\n"))
+	}))
+	kubelet.Config.ErrorLog = log.New(io.Discard, "", 0)
+	kubelet.StartTLS()
+	defer kubelet.Close()
+	host, port, err := net.SplitHostPort(kubelet.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := fakeNode("node-a")
+	node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: host}}
+	kubeletPort, _ := strconv.Atoi(port)
+	node.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(kubeletPort)
+
+	// The kubelet's certificate is verified against -ca-file
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kubelet.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &rest.Config{Host: "https://apiserver.example:6443", BearerToken: "sa-token"}
+	tests := []struct {
+		name    string
+		flags   clusterFlags
+		wantErr string
+	}{
+		{name: "cluster CA", flags: clusterFlags{maxInFlight: defaultMaxInFlight, direct: true}, wantErr: "certificate"},
+		{name: "CA file", flags: clusterFlags{maxInFlight: defaultMaxInFlight, direct: true, caFile: caFile}},
+		{name: "insecure", flags: clusterFlags{maxInFlight: defaultMaxInFlight, direct: true, insecureTLS: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorization = ""
+			client, err := tt.flags.newClient(config)
+			if err != nil {
+				t.Fatalf("newClient: %v", err)
+			}
+			_, err = client.scrapeNode(context.Background(), node, "metrics")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one about the %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scrapeNode: %v", err)
+			}
+			if authorization != "Bearer sa-token" {
+				t.Errorf("Authorization = %q, want the ServiceAccount token", authorization)
+			}
+		})
+	}
+
+	impersonating := rest.CopyConfig(config)
+	impersonating.Impersonate.UserName = "jane"
+	flags := clusterFlags{maxInFlight: defaultMaxInFlight, direct: true, insecureTLS: true}
+	if _, err := flags.newClient(impersonating); err == nil {
+		t.Error("newClient accepted impersonation with -direct")
+	}
+}
+
+func TestClusterFlagsLimits(t *testing.T) {
+	config := &rest.Config{Host: "https://apiserver.example:6443"}
+	tests := []struct {
+		name    string
+		flags   clusterFlags
+		wantErr string
+	}{
+		{name: "default", flags: clusterFlags{maxInFlight: defaultMaxInFlight, qps: defaultQPS, burst: defaultBurst}},
+		{name: "burst of one", flags: clusterFlags{maxInFlight: defaultMaxInFlight, qps: 5, burst: 1}},
+		{name: "zero burst", flags: clusterFlags{maxInFlight: defaultMaxInFlight, qps: 5, burst: 0}, wantErr: "-burst must be at least 1 when -qps is set, got 0"},
+		{name: "negative burst", flags: clusterFlags{maxInFlight: defaultMaxInFlight, qps: 5, burst: -1}, wantErr: "-burst must be at least 1 when -qps is set, got -1"},
+		{name: "no rate limit", flags: clusterFlags{maxInFlight: defaultMaxInFlight, qps: 0, burst: 0}},
+		{name: "one in flight", flags: clusterFlags{maxInFlight: 1}},
+		{name: "zero in flight", flags: clusterFlags{maxInFlight: 0}, wantErr: "-max-in-flight must be at least 1, got 0"},
+		{name: "negative in flight", flags: clusterFlags{maxInFlight: -1}, wantErr: "-max-in-flight must be at least 1, got -1"},
+		{name: "no response size limit", flags: clusterFlags{maxInFlight: defaultMaxInFlight, maxResponseSize: 0}},
+		{name: "negative response size", flags: clusterFlags{maxInFlight: defaultMaxInFlight, maxResponseSize: -1}, wantErr: "-max-response-size must not be negative, got -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := tt.flags.newClient(rest.CopyConfig(config))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("newClient = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newClient: %v", err)
+			}
+
+			// Accepted limits let requests through
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := client.clientset.CoreV1().RESTClient().GetRateLimiter().Wait(ctx); err != nil {
+				t.Errorf("rate limiter Wait: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseEvalTime(t *testing.T) {
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", now, false},
+		{"now", now, false},
+		{"-2m", now.Add(-2 * time.Minute), false},
+		{"+30s", now.Add(30 * time.Second), false},
+		{"-1h30m", now.Add(-90 * time.Minute), false},
+		{"2025-05-01T10:00:00Z", time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC), false},
+		{"2025-05-01T10:00:00.5+02:00", time.Date(2025, 5, 1, 8, 0, 0, 5e8, time.UTC), false},
+		{"1746100800", time.Unix(1746100800, 0), false},
+		{"1746100800.25", time.Unix(1746100800, 25e7), false},
+		{"-2x", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseEvalTime(tt.value, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEvalTime(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseEvalTime(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateQueriesEvalTime(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "rules.yaml")
+	rules := `groups:
+- name: kubelet
+  rules:
+  - record: cluster:kubelet_running_pods:sum
+    expr: sum(kubelet_running_pods)
+`
+	if err := os.WriteFile(rulesFile, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ruleGroups, err := loadRules(rulesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		evalTime string
+		want     int
+	}{
+		// The default and "now" resolve after collection, so the samples are
+		// within the lookback delta
+		{"", 1},
+		{"now", 1},
+		{"+4m", 1},
+		{"+6m", 0},
+		{"-1m", 0},
+	}
+	for _, tt := range tests {
+		cluster := newStandardFakeCluster(t)
+		store := newTestStore(t)
+		if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+			t.Fatal(err)
+		}
+		// Queries run a while after the samples were scraped
+		time.Sleep(50 * time.Millisecond)
+
+		cfg := queryConfig{
+			queries: []NamedQuery{
+				{Name: "pods", Query: "kubelet_running_pods"},
+				{Name: "recorded", Query: "cluster:kubelet_running_pods:sum"},
+			},
+			evalTime:   tt.evalTime,
+			ruleGroups: ruleGroups,
+		}
+		outputs, err := evaluateQueries(context.Background(), store, cfg, false)
+		if err != nil {
+			t.Fatalf("-time %q: %v", tt.evalTime, err)
+		}
+		for _, output := range outputs {
+			if len(output.Results) != tt.want {
+				t.Errorf("-time %q: %s returned %d results, want %d", tt.evalTime, output.Name, len(output.Results), tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// MetricMetadata is the HELP, TYPE and UNIT a target exposes for a metric
+type MetricMetadata struct {
+	Type model.MetricType `json:"type"`
+	Help string           `json:"help"`
+	Unit string           `json:"unit"`
+}
+
+// MetricInfo summarises a metric name in the store
+type MetricInfo struct {
+	Name       string           `json:"name"`
+	Type       model.MetricType `json:"type"`
+	Help       string           `json:"help"`
+	Unit       string           `json:"unit,omitempty"`
+	Series     int              `json:"series"`
+	Targets    []string         `json:"targets"`
+	LabelNames []string         `json:"labelNames"`
+}
+
+// familyMetadata extracts the metadata of a metric family
+func familyMetadata(family *dto.MetricFamily) MetricMetadata {
+	return MetricMetadata{
+		Type: metricType(family.GetType()),
+		Help: family.GetHelp(),
+		Unit: family.GetUnit(),
+	}
+}
+
+// metricType converts an exposition metric type to the name used by the Prometheus API
+func metricType(t dto.MetricType) model.MetricType {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return model.MetricTypeCounter
+	case dto.MetricType_GAUGE:
+		return model.MetricTypeGauge
+	case dto.MetricType_HISTOGRAM:
+		return model.MetricTypeHistogram
+	case dto.MetricType_GAUGE_HISTOGRAM:
+		return model.MetricTypeGaugeHistogram
+	case dto.MetricType_SUMMARY:
+		return model.MetricTypeSummary
+	default:
+		return model.MetricTypeUnknown
+	}
+}
+
+// setMetadata records the metadata a target exposes for a metric.
+// The caller must hold the store mutex.
+func (s *MetricStore) setMetadata(metricName, target string, metadata MetricMetadata) {
+	byTarget, ok := s.metadata[metricName]
+	if !ok {
+		byTarget = make(map[string]MetricMetadata)
+		s.metadata[metricName] = byTarget
+	}
+	byTarget[target] = metadata
+}
+
+// Metadata returns the distinct metadata of every metric, keyed by metric name,
+// in the layout of the Prometheus /api/v1/metadata endpoint
+func (s *MetricStore) Metadata() map[string][]MetricMetadata {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := make(map[string][]MetricMetadata, len(s.metadata))
+	for metricName, byTarget := range s.metadata {
+		var distinct []MetricMetadata
+		for _, target := range sortedKeys(byTarget) {
+			metadata := byTarget[target]
+			seen := false
+			for _, existing := range distinct {
+				if existing == metadata {
+					seen = true
+					break
+				}
+			}
+			if !seen {
+				distinct = append(distinct, metadata)
+			}
+		}
+		result[metricName] = distinct
+	}
+	return result
+}
+
+// Metrics returns a summary of every metric name in the store sorted by name:
+// the names of its series, such as those of recording rules and ALERTS, and
+// the names targets exposed metadata for. Metrics without metadata have the
+// unknown type. When targets disagree on a metric's metadata, the first
+// target by name wins.
+func (s *MetricStore) Metrics() []MetricInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// Count the series and gather the label names of each metric name
+	seriesCounts := make(map[string]int)
+	labelNames := make(map[string]map[string]struct{})
+	for _, series := range s.series {
+		metricName := series.SeriesLabels.Get(labels.MetricName)
+		seriesCounts[metricName]++
+		names, ok := labelNames[metricName]
+		if !ok {
+			names = make(map[string]struct{})
+			labelNames[metricName] = names
+		}
+		series.SeriesLabels.Range(func(l labels.Label) {
+			if l.Name != labels.MetricName {
+				names[l.Name] = struct{}{}
+			}
+		})
+	}
+	for metricName := range s.metadata {
+		if _, ok := labelNames[metricName]; !ok {
+			labelNames[metricName] = nil
+		}
+	}
+
+	metrics := make([]MetricInfo, 0, len(labelNames))
+	for metricName, names := range labelNames {
+		info := MetricInfo{
+			Name:       metricName,
+			Type:       model.MetricTypeUnknown,
+			Series:     seriesCounts[metricName],
+			Targets:    []string{},
+			LabelNames: sortedKeys(names),
+		}
+		if byTarget, ok := s.metadata[metricName]; ok {
+			info.Targets = sortedKeys(byTarget)
+			metadata := byTarget[info.Targets[0]]
+			info.Type, info.Help, info.Unit = metadata.Type, metadata.Help, metadata.Unit
+		}
+		metrics = append(metrics, info)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+	return metrics
+}
+
+// filterMetrics returns the metrics whose name matches nameRegex, when it is
+// set, and that are exposed by component, when it is not empty. With several
+// clusters, component matches the targets of that component in every cluster,
+// and a full cluster/component target name matches only that cluster.
+func filterMetrics(metrics []MetricInfo, nameRegex *regexp.Regexp, component string) []MetricInfo {
+	filtered := make([]MetricInfo, 0, len(metrics))
+	for _, metric := range metrics {
+		if nameRegex != nil && !nameRegex.MatchString(metric.Name) {
+			continue
+		}
+		if component != "" && !slices.ContainsFunc(metric.Targets, func(target string) bool {
+			return target == component || strings.HasSuffix(target, "/"+component)
+		}) {
+			continue
+		}
+		filtered = append(filtered, metric)
+	}
+	return filtered
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestMetricStoreMetricsWithoutMetadata(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	store := newTestStore(t)
+	if err := collectAllMetrics(context.Background(), store, cluster.client(), false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+
+	// Recording rule outputs and alerts are stored without metadata
+	store.AddSamples(promql.Vector{
+		{Metric: labels.FromStrings(labels.MetricName, "cluster:kubelet_running_pods:sum"), T: 1000, F: 12},
+		{Metric: labels.FromStrings(labels.MetricName, "ALERTS", "alertname", "KubeletDown", "alertstate", "firing"), T: 1000, F: 1},
+		{Metric: labels.FromStrings(labels.MetricName, "ALERTS", "alertname", "KubeletTooManyPods", "alertstate", "pending"), T: 1000, F: 1},
+	})
+
+	metrics := make(map[string]MetricInfo)
+	for _, metric := range store.Metrics() {
+		metrics[metric.Name] = metric
+	}
+
+	tests := []struct {
+		name           string
+		wantType       model.MetricType
+		wantSeries     int
+		wantTargets    []string
+		wantLabelNames []string
+	}{
+		{"cluster:kubelet_running_pods:sum", model.MetricTypeUnknown, 1, []string{}, []string{}},
+		{"ALERTS", model.MetricTypeUnknown, 2, []string{}, []string{"alertname", "alertstate"}},
+		{"kubelet_running_pods", model.MetricTypeGauge, 1, []string{"kubelet"}, []string{}},
+	}
+	for _, tt := range tests {
+		metric, ok := metrics[tt.name]
+		if !ok {
+			t.Errorf("%s not listed", tt.name)
+			continue
+		}
+		if metric.Type != tt.wantType || metric.Series != tt.wantSeries ||
+			!slices.Equal(metric.Targets, tt.wantTargets) || !slices.Equal(metric.LabelNames, tt.wantLabelNames) {
+			t.Errorf("%s = %s with %d series, targets %q and labels %q, want %s with %d, %q and %q", tt.name,
+				metric.Type, metric.Series, metric.Targets, metric.LabelNames,
+				tt.wantType, tt.wantSeries, tt.wantTargets, tt.wantLabelNames)
+		}
+	}
+}
+
+func TestFilterMetricsMultiContext(t *testing.T) {
+	staging := newStandardFakeCluster(t)
+	prod := newStandardFakeCluster(t)
+	prod.serveError(nodeProxyPath("node-a", "metrics"), http.StatusBadGateway)
+
+	stagingClient := staging.client()
+	stagingClient.cluster = "staging"
+	prodClient := prod.client()
+	prodClient.cluster = "prod"
+
+	store := newTestStore(t)
+	if err := collectClusters(context.Background(), store, []*clusterClient{stagingClient, prodClient}, false); err != nil {
+		t.Fatalf("collectClusters: %v", err)
+	}
+	metrics := store.Metrics()
+
+	tests := []struct {
+		component string
+		regex     string
+		want      map[string][]string // targets of the listed metrics, by name
+	}{
+		{
+			component: "kubelet",
+			regex:     "^kubelet_running_pods$",
+			want:      map[string][]string{"kubelet_running_pods": {"staging/kubelet"}},
+		},
+		{
+			component: "apiserver",
+			regex:     "^apiserver_request_total$",
+			want:      map[string][]string{"apiserver_request_total": {"prod/apiserver", "staging/apiserver"}},
+		},
+		{
+			component: "prod/apiserver",
+			regex:     "^apiserver_request_total$",
+			want:      map[string][]string{"apiserver_request_total": {"prod/apiserver", "staging/apiserver"}},
+		},
+		{component: "prod/kubelet", regex: "^kubelet_running_pods$", want: map[string][]string{}},
+		{component: "let", regex: "^kubelet_running_pods$", want: map[string][]string{}},
+		{component: "staging", regex: "^kubelet_running_pods$", want: map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.component, func(t *testing.T) {
+			got := make(map[string][]string)
+			for _, metric := range filterMetrics(metrics, regexp.MustCompile(tt.regex), tt.component) {
+				got[metric.Name] = metric.Targets
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterMetrics(%q) = %v, want %v", tt.component, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// runMetrics collects metrics once and lists every metric name with its
+// metadata, series count, source components and label names
+func runMetrics(args []string) {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	var cluster clusterFlags
+	var output string
+	var nameRegex string
+	var component string
+
+	cluster.register(fs)
+	fs.StringVar(&output, "output", outputTable,
+		"Output format: table or json")
+	fs.StringVar(&nameRegex, "regex", "",
+		"Only list metrics whose name matches this regular expression")
+	fs.StringVar(&component, "component", "",
+		"Only list metrics exposed by this component, such as kubelet or apiserver")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s metrics [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "List the metrics exposed by the Kubernetes components together with their\n")
+		fmt.Fprintf(fs.Output(), "type, unit, number of series, the targets that expose them, their label\n")
+		fmt.Fprintf(fs.Output(), "names and help text.\n\n")
+		fmt.Fprintf(fs.Output(), "Examples:\n")
+		fmt.Fprintf(fs.Output(), "  %s metrics\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s metrics -component kubelet -regex '^kubelet_.*_seconds'\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s metrics -output json\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	cluster.parse(fs, args)
+
+	if err := validateOutputFormat(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var re *regexp.Regexp
+	if nameRegex != "" {
+		var err error
+		re, err = regexp.Compile(nameRegex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -regex value: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	store, err := cluster.collect(DefaultEngineOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	metrics := filterMetrics(store.Metrics(), re, component)
+	if err := displayMetrics(output, metrics); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
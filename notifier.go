@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/rules"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// alertmanagerAlertsPath is the Alertmanager v2 API endpoint alerts are posted to
+	alertmanagerAlertsPath = "/api/v2/alerts"
+
+	// defaultResendDelay matches the Prometheus --rules.alert.resend-delay default
+	defaultResendDelay = time.Minute
+
+	// notifyTimeout bounds a single request to an Alertmanager
+	notifyTimeout = 10 * time.Second
+
+	// notifyRoundTimeout bounds discovering the Alertmanagers and sending them
+	// the alerts of one evaluation, independently of the collection before it
+	notifyRoundTimeout = 30 * time.Second
+)
+
+// alertmanagerAlert is an alert in the Alertmanager v2 API
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt,omitempty"`
+	EndsAt       time.Time         `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// alertmanagerURLs collects the values of a repeatable -alertmanager-url flag
+type alertmanagerURLs []string
+
+func (u *alertmanagerURLs) String() string {
+	return strings.Join(*u, ", ")
+}
+
+func (u *alertmanagerURLs) Set(value string) error {
+	*u = append(*u, value)
+	return nil
+}
+
+// alertmanagerService is a Service whose ready endpoints are Alertmanagers
+type alertmanagerService struct {
+	namespace string
+	name      string
+	port      string // port name or number; the first port when empty
+}
+
+// parseAlertmanagerService parses namespace/name or namespace/name:port
+func parseAlertmanagerService(value string) (*alertmanagerService, error) {
+	namespace, remainder, ok := strings.Cut(value, "/")
+	if !ok || namespace == "" || remainder == "" {
+		return nil, fmt.Errorf("invalid Alertmanager service %q, expected namespace/name[:port]", value)
+	}
+	name, port, _ := strings.Cut(remainder, ":")
+	return &alertmanagerService{namespace: namespace, name: name, port: port}, nil
+}
+
+// alertNotifier sends firing and resolved alerts to Alertmanagers. Like
+// Prometheus, it re-sends active alerts every resendDelay so Alertmanager does
+// not resolve them, and sends each resolved alert once more with its end time.
+type alertNotifier struct {
+	client      *http.Client
+	urls        []string
+	resendDelay time.Duration
+	interval    time.Duration
+	timeout     time.Duration // bounds a single request to an Alertmanager
+
+	// service, when set, adds the endpoints of an Alertmanager Service in
+	// every cluster to urls
+	service  *alertmanagerService
+	clusters []*clusterClient
+}
+
+// newAlertNotifier creates a notifier for the given Alertmanager URLs and the
+// optional Alertmanager Service, given as namespace/name[:port], which is
+// discovered in every cluster of clients
+func newAlertNotifier(clients []*clusterClient, urls []string, service string, resendDelay, interval time.Duration) (*alertNotifier, error) {
+	n := &alertNotifier{
+		client:      &http.Client{},
+		urls:        urls,
+		resendDelay: resendDelay,
+		interval:    interval,
+		timeout:     notifyTimeout,
+	}
+	if service == "" {
+		return n, nil
+	}
+
+	var err error
+	n.service, err = parseAlertmanagerService(service)
+	if err != nil {
+		return nil, err
+	}
+	n.clusters = clients
+	return n, nil
+}
+
+// notify sends the alerts of groups that need sending at ts to every Alertmanager
+func (n *alertNotifier) notify(ctx context.Context, groups []*ruleGroup, ts time.Time) error {
+	alerts, markSent := n.pendingNotifications(groups, ts)
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	urls, err := n.alertmanagers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("no Alertmanagers to send %d alerts to", len(alerts))
+	}
+
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return fmt.Errorf("encoding alerts: %w", err)
+	}
+
+	// Alerts no Alertmanager accepted are sent again at the next evaluation
+	// instead of waiting for the resend delay
+	var errs []error
+	sent := false
+	for _, baseURL := range urls {
+		if err := n.send(ctx, baseURL, body); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		markSent()
+	}
+	return errors.Join(errs...)
+}
+
+// pendingNotifications returns the firing and resolved alerts that have not
+// been sent since they changed or for longer than the resend delay, and a
+// function marking them as sent at ts
+func (n *alertNotifier) pendingNotifications(groups []*ruleGroup, ts time.Time) ([]alertmanagerAlert, func()) {
+	// Allow for two missed evaluations or failed sends before Alertmanager
+	// resolves an alert on its own
+	validUntil := ts.Add(4 * max(n.resendDelay, n.interval))
+
+	var alerts []alertmanagerAlert
+	pending := make(map[*rules.Alert]bool)
+	forEachAlert(groups, func(alert *rules.Alert) {
+		if !needsSending(alert, ts, n.resendDelay) {
+			return
+		}
+		pending[alert] = true
+
+		endsAt := validUntil
+		if !alert.ResolvedAt.IsZero() {
+			endsAt = alert.ResolvedAt
+		}
+		alerts = append(alerts, alertmanagerAlert{
+			Labels:      alert.Labels.Map(),
+			Annotations: alert.Annotations.Map(),
+			StartsAt:    alert.FiredAt,
+			EndsAt:      endsAt,
+		})
+	})
+
+	markSent := func() {
+		forEachAlert(groups, func(alert *rules.Alert) {
+			if pending[alert] {
+				alert.LastSentAt = ts
+				alert.ValidUntil = validUntil
+			}
+		})
+	}
+	return alerts, markSent
+}
+
+// forEachAlert calls f with every active alert of the alerting rules in
+// groups, holding the lock of its rule
+func forEachAlert(groups []*ruleGroup, f func(*rules.Alert)) {
+	for _, group := range groups {
+		for _, rule := range group.rules {
+			if alertingRule, ok := rule.(*rules.AlertingRule); ok {
+				alertingRule.ForEachActiveAlert(f)
+			}
+		}
+	}
+}
+
+// needsSending mirrors the Prometheus rule manager: pending alerts are never
+// sent, resolved alerts are sent once when they resolve, and other alerts are
+// re-sent once resendDelay has passed
+func needsSending(alert *rules.Alert, ts time.Time, resendDelay time.Duration) bool {
+	if alert.State == rules.StatePending {
+		return false
+	}
+	if alert.ResolvedAt.After(alert.LastSentAt) {
+		return true
+	}
+	return alert.LastSentAt.Add(resendDelay).Before(ts)
+}
+
+// alertmanagers returns the configured Alertmanager URLs and the endpoints of
+// the Alertmanager Service in every cluster, if one is set. A cluster whose
+// Service cannot be listed is reported without losing the others.
+func (n *alertNotifier) alertmanagers(ctx context.Context) ([]string, error) {
+	urls := append([]string(nil), n.urls...)
+	if n.service == nil {
+		return urls, nil
+	}
+
+	var errs []error
+	for _, cluster := range n.clusters {
+		discovered, err := n.service.discover(ctx, cluster.clientset)
+		if err != nil {
+			if cluster.cluster != "" {
+				err = fmt.Errorf("cluster %s: %w", cluster.cluster, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		for _, url := range discovered {
+			if !slices.Contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+	}
+	if len(urls) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return urls, errors.Join(errs...)
+}
+
+// discover returns the URLs of the ready endpoints of the Service
+func (s *alertmanagerService) discover(ctx context.Context, clientset kubernetes.Interface) ([]string, error) {
+	endpointSlices, err := clientset.DiscoveryV1().EndpointSlices(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + s.name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("discovering Alertmanagers from service %s/%s: %w", s.namespace, s.name, err)
+	}
+
+	var urls []string
+	for _, slice := range endpointSlices.Items {
+		port, ok := s.endpointPort(slice.Ports)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				host := address
+				if slice.AddressType == discoveryv1.AddressTypeIPv6 {
+					host = "[" + address + "]"
+				}
+				urls = append(urls, fmt.Sprintf("http://%s:%d", host, port))
+			}
+		}
+	}
+	return urls, nil
+}
+
+// endpointPort returns the port of an EndpointSlice matching the service port
+// name or number, or the first port when none was given
+func (s *alertmanagerService) endpointPort(ports []discoveryv1.EndpointPort) (int32, bool) {
+	for _, port := range ports {
+		if port.Port == nil {
+			continue
+		}
+		if s.port == "" ||
+			(port.Name != nil && *port.Name == s.port) ||
+			strconv.Itoa(int(*port.Port)) == s.port {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
+
+// send posts encoded alerts to the Alertmanager at baseURL
+func (n *alertNotifier) send(ctx context.Context, baseURL string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+
+	endpoint := strings.TrimSuffix(baseURL, "/") + alertmanagerAlertsPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request for %s: %w", endpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending alerts to %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sending alerts to %s: unexpected status %s", endpoint, resp.Status)
+	}
+	return nil
+}
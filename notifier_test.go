@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/rules"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// fakeAlertmanager records the alerts posted to it
+type fakeAlertmanager struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	posts [][]alertmanagerAlert
+}
+
+// newFakeAlertmanager starts an Alertmanager that answers with status
+func newFakeAlertmanager(t *testing.T, status int) *fakeAlertmanager {
+	t.Helper()
+
+	am := &fakeAlertmanager{}
+	am.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != alertmanagerAlertsPath {
+			http.NotFound(w, r)
+			return
+		}
+		var alerts []alertmanagerAlert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		am.mu.Lock()
+		am.posts = append(am.posts, alerts)
+		am.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(am.Close)
+	return am
+}
+
+// received returns and clears the alerts posted since the last call
+func (am *fakeAlertmanager) received() [][]alertmanagerAlert {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	posts := am.posts
+	am.posts = nil
+	return posts
+}
+
+const notifierTestRules = `groups:
+- name: test
+  rules:
+  - alert: TestMetricPositive
+    expr: test_metric > 0
+    labels:
+      severity: warning
+    annotations:
+      summary: test_metric is {{ $value }}
+`
+
+func TestAlertNotifierLifecycle(t *testing.T) {
+	am := newFakeAlertmanager(t, http.StatusOK)
+	notifier, err := newAlertNotifier(nil, []string{am.URL}, "", time.Minute, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := writeRuleFile(t, notifierTestRules)
+	store := newEngineTestStore(t, DefaultEngineOptions())
+	ctx := context.Background()
+
+	evaluate := func(ts time.Time) [][]alertmanagerAlert {
+		t.Helper()
+		if err := store.EvaluateRules(ctx, groups, ts); err != nil {
+			t.Fatalf("EvaluateRules at %s: %v", ts, err)
+		}
+		if err := notifier.notify(ctx, groups, ts); err != nil {
+			t.Fatalf("notify at %s: %v", ts, err)
+		}
+		return am.received()
+	}
+
+	firedAt := testTime(time.Minute)
+	wantLabels := map[string]string{
+		labels.AlertName: "TestMetricPositive",
+		"job":            "test",
+		"severity":       "warning",
+	}
+	firing := func(sentAt time.Time, value string) [][]alertmanagerAlert {
+		return [][]alertmanagerAlert{{{
+			Labels:      wantLabels,
+			Annotations: map[string]string{"summary": "test_metric is " + value},
+			StartsAt:    firedAt,
+			EndsAt:      sentAt.Add(4 * time.Minute),
+		}}}
+	}
+
+	// A firing alert is sent as soon as it fires
+	if got, want := evaluate(firedAt), firing(firedAt, "4"); !reflect.DeepEqual(got, want) {
+		t.Errorf("first evaluation sent %+v, want %+v", got, want)
+	}
+
+	// It is not sent again within the resend delay
+	if got := evaluate(testTime(90 * time.Second)); len(got) != 0 {
+		t.Errorf("evaluation within the resend delay sent %+v, want nothing", got)
+	}
+
+	// It is re-sent with a new end time once the resend delay has passed
+	resentAt := testTime(2*time.Minute + 15*time.Second)
+	if got, want := evaluate(resentAt), firing(resentAt, "9"); !reflect.DeepEqual(got, want) {
+		t.Errorf("evaluation after the resend delay sent %+v, want %+v", got, want)
+	}
+
+	// When it resolves it is sent once more, ending when it resolved and
+	// keeping the annotations of its last active evaluation
+	resolvedAt := testTime(11 * time.Minute)
+	store.appendSample(labels.FromStrings(labels.MetricName, "test_metric", "job", "test"), resolvedAt.UnixMilli(), 0)
+	want := [][]alertmanagerAlert{{{
+		Labels:      wantLabels,
+		Annotations: map[string]string{"summary": "test_metric is 9"},
+		StartsAt:    firedAt,
+		EndsAt:      resolvedAt,
+	}}}
+	if got := evaluate(resolvedAt); !reflect.DeepEqual(got, want) {
+		t.Errorf("resolving evaluation sent %+v, want %+v", got, want)
+	}
+	if got := evaluate(resolvedAt.Add(30 * time.Second)); len(got) != 0 {
+		t.Errorf("evaluation after resolving sent %+v, want nothing", got)
+	}
+}
+
+func TestAlertNotifierErrors(t *testing.T) {
+	healthy := newFakeAlertmanager(t, http.StatusOK)
+	failing := newFakeAlertmanager(t, http.StatusInternalServerError)
+
+	stalled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stalled:
+		}
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(stalled) })
+
+	tests := []struct {
+		name     string
+		urls     []string
+		wantErrs []string
+	}{
+		{
+			name:     "non-2xx status",
+			urls:     []string{failing.URL, healthy.URL},
+			wantErrs: []string{failing.URL + alertmanagerAlertsPath, "unexpected status 500"},
+		},
+		{
+			name:     "timeout",
+			urls:     []string{slow.URL, healthy.URL},
+			wantErrs: []string{slow.URL + alertmanagerAlertsPath, context.DeadlineExceeded.Error()},
+		},
+		{
+			name:     "no Alertmanagers",
+			wantErrs: []string{"no Alertmanagers to send 1 alerts to"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := writeRuleFile(t, notifierTestRules)
+			store := newEngineTestStore(t, DefaultEngineOptions())
+			ts := testTime(10 * time.Minute)
+			if err := store.EvaluateRules(context.Background(), groups, ts); err != nil {
+				t.Fatal(err)
+			}
+			notifier, err := newAlertNotifier(nil, tt.urls, "", time.Minute, 30*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			notifier.timeout = 50 * time.Millisecond
+
+			err = notifier.notify(context.Background(), groups, ts)
+			if err == nil {
+				t.Fatalf("notify succeeded, want an error containing %q", tt.wantErrs)
+			}
+			for _, want := range tt.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("notify = %v, want an error containing %q", err, want)
+				}
+			}
+
+			// A failing Alertmanager does not stop the others
+			if len(tt.urls) > 0 {
+				if got := healthy.received(); len(got) != 1 || len(got[0]) != 1 {
+					t.Errorf("healthy Alertmanager received %+v, want one alert", got)
+				}
+			}
+		})
+	}
+}
+
+func TestAlertNotifierRetriesUnsentAlerts(t *testing.T) {
+	groups := writeRuleFile(t, notifierTestRules)
+	store := newEngineTestStore(t, DefaultEngineOptions())
+	ts := testTime(10 * time.Minute)
+	if err := store.EvaluateRules(context.Background(), groups, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := newFakeAlertmanager(t, http.StatusServiceUnavailable)
+	healthy := newFakeAlertmanager(t, http.StatusOK)
+	failingNotifier, err := newAlertNotifier(nil, []string{failing.URL}, "", time.Minute, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthyNotifier, err := newAlertNotifier(nil, []string{healthy.URL}, "", time.Minute, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No Alertmanager accepted the alert, so it is not marked as sent
+	if err := failingNotifier.notify(context.Background(), groups, ts); err == nil {
+		t.Fatal("notify succeeded, want the 503 error")
+	}
+	var lastSent []time.Time
+	forEachAlert(groups, func(alert *rules.Alert) { lastSent = append(lastSent, alert.LastSentAt) })
+	if len(lastSent) != 1 || !lastSent[0].IsZero() {
+		t.Errorf("LastSentAt after a failed send = %v, want zero", lastSent)
+	}
+
+	// The next evaluation sends it, well within the resend delay
+	next := ts.Add(30 * time.Second)
+	if err := healthyNotifier.notify(context.Background(), groups, next); err != nil {
+		t.Fatal(err)
+	}
+	if got := healthy.received(); len(got) != 1 || len(got[0]) != 1 || !got[0][0].EndsAt.Equal(next.Add(4*time.Minute)) {
+		t.Errorf("retry sent %+v, want the alert valid for 4m from %s", got, next)
+	}
+
+	// Once accepted, it waits for the resend delay again
+	if err := healthyNotifier.notify(context.Background(), groups, next.Add(30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := healthy.received(); len(got) != 0 {
+		t.Errorf("evaluation within the resend delay sent %+v, want nothing", got)
+	}
+}
+
+// endpointSlice returns an EndpointSlice of service with one endpoint per
+// address, marked ready unless listed in notReady
+func endpointSlice(namespace, service, name string, addressType discoveryv1.AddressType, ports map[string]int32, addresses []string, notReady ...string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: addressType,
+	}
+	for portName, port := range ports {
+		slice.Ports = append(slice.Ports, discoveryv1.EndpointPort{Name: &portName, Port: &port})
+	}
+	for _, address := range addresses {
+		ready := !slices.Contains(notReady, address)
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{address},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		})
+	}
+	return slice
+}
+
+func TestAlertmanagerServiceDiscovery(t *testing.T) {
+	objects := []runtime.Object{
+		endpointSlice("monitoring", "alertmanager", "alertmanager-ipv4", discoveryv1.AddressTypeIPv4,
+			map[string]int32{"web": 9093},
+			[]string{"10.0.0.1", "10.0.0.2"}, "10.0.0.2"),
+		endpointSlice("monitoring", "alertmanager", "alertmanager-ipv6", discoveryv1.AddressTypeIPv6,
+			map[string]int32{"web": 9093},
+			[]string{"fd00::1"}),
+		// Slices of other services and namespaces are ignored
+		endpointSlice("monitoring", "grafana", "grafana", discoveryv1.AddressTypeIPv4,
+			map[string]int32{"web": 3000},
+			[]string{"10.0.0.9"}),
+		endpointSlice("default", "alertmanager", "alertmanager", discoveryv1.AddressTypeIPv4,
+			map[string]int32{"web": 9093},
+			[]string{"10.0.1.1"}),
+	}
+
+	tests := []struct {
+		service string
+		want    []string
+	}{
+		{service: "monitoring/alertmanager", want: []string{"http://10.0.0.1:9093", "http://[fd00::1]:9093"}},
+		{service: "monitoring/alertmanager:web", want: []string{"http://10.0.0.1:9093", "http://[fd00::1]:9093"}},
+		{service: "monitoring/alertmanager:9093", want: []string{"http://10.0.0.1:9093", "http://[fd00::1]:9093"}},
+		{service: "monitoring/alertmanager:mesh"},
+		{service: "monitoring/missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			clients := []*clusterClient{{clientset: fake.NewSimpleClientset(objects...)}}
+			notifier, err := newAlertNotifier(clients, []string{"http://static:9093"}, tt.service, time.Minute, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := notifier.alertmanagers(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]string{"http://static:9093"}, tt.want...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("alertmanagers = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAlertmanagerServiceDiscoveryPerCluster(t *testing.T) {
+	prod := fake.NewSimpleClientset(endpointSlice("monitoring", "alertmanager", "alertmanager", discoveryv1.AddressTypeIPv4,
+		map[string]int32{"web": 9093}, []string{"10.0.0.1"}))
+	staging := fake.NewSimpleClientset(endpointSlice("monitoring", "alertmanager", "alertmanager", discoveryv1.AddressTypeIPv4,
+		map[string]int32{"web": 9093}, []string{"10.1.0.1"}))
+	clients := []*clusterClient{
+		{clientset: prod, cluster: "prod"},
+		{clientset: staging, cluster: "staging"},
+	}
+	notifier, err := newAlertNotifier(clients, nil, "monitoring/alertmanager", time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := notifier.alertmanagers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://10.0.0.1:9093", "http://10.1.0.1:9093"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alertmanagers = %q, want %q", got, want)
+	}
+
+	// A cluster that cannot be listed is reported with its name, and the
+	// Alertmanagers of the others are still returned
+	staging.PrependReactor("list", "endpointslices", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+	got, err = notifier.alertmanagers(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "cluster staging") || !strings.Contains(err.Error(), "forbidden") {
+		t.Errorf("alertmanagers error = %v, want the staging listing error", err)
+	}
+	if want := []string{"http://10.0.0.1:9093"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alertmanagers = %q, want %q", got, want)
+	}
+}
+
+func TestAlertNotifierSendsToDiscoveredAlertmanager(t *testing.T) {
+	am := newFakeAlertmanager(t, http.StatusOK)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(am.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientset := fake.NewSimpleClientset(endpointSlice("monitoring", "alertmanager", "alertmanager", discoveryv1.AddressTypeIPv4,
+		map[string]int32{"web": int32(portNumber)}, []string{host}))
+
+	notifier, err := newAlertNotifier([]*clusterClient{{clientset: clientset}}, nil, "monitoring/alertmanager:web", time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := writeRuleFile(t, notifierTestRules)
+	store := newEngineTestStore(t, DefaultEngineOptions())
+	ts := testTime(10 * time.Minute)
+	if err := store.EvaluateRules(context.Background(), groups, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.notify(context.Background(), groups, ts); err != nil {
+		t.Fatal(err)
+	}
+	if got := am.received(); len(got) != 1 || len(got[0]) != 1 || got[0][0].Labels[labels.AlertName] != "TestMetricPositive" {
+		t.Errorf("discovered Alertmanager received %+v, want TestMetricPositive", got)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Output formats supported by the -output flag
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// queryOutput is the result of one named query, with its explanation when requested
+type queryOutput struct {
+	*QueryResult
+	Explain *QueryExplanation `json:"explain,omitempty"`
+}
+
+// validateOutputFormat checks that format is one of the supported output formats
+func validateOutputFormat(format string) error {
+	switch format {
+	case outputTable, outputJSON:
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q (expected %s or %s)", format, outputTable, outputJSON)
+	}
+}
+
+// displayQueryResults outputs the results of each query, grouped by query name,
+// in the requested format. JSON output is a list with one entry per query.
+func displayQueryResults(format string, outputs []queryOutput) error {
+	switch format {
+	case outputJSON:
+		return writeJSON(os.Stdout, outputs)
+	default:
+		for _, output := range outputs {
+			displayResults(output.QueryResult)
+			if output.Explain != nil {
+				displayExplanation(output.Explain)
+			}
+		}
+		return nil
+	}
+}
+
+// writeJSON writes v to w as indented JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// displayResults outputs the query results in a formatted table
+func displayResults(result *QueryResult) {
+	results := result.Results
+	if result.Name != "" && result.Name != result.Query {
+		fmt.Printf("\nQuery: %s\n", result.Name)
+		fmt.Printf("Expression: %s\n", result.Query)
+	} else {
+		fmt.Printf("\nQuery: %s\n", result.Query)
+	}
+	fmt.Printf("Results: %d metrics found\n\n", len(results))
+
+	if len(results) == 0 {
+		fmt.Println("No metrics found matching the query.")
+	} else {
+		displayResultTable(results)
+	}
+
+	displayAnnotations(result)
+}
+
+// displayResultTable outputs metric results as an aligned table
+func displayResultTable(results []MetricResult) {
+	// Create tabwriter for aligned output
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+
+	// Print header
+	fmt.Fprintln(w, "METRIC\tLABELS\tVALUE\tTIMESTAMP")
+	fmt.Fprintln(w, "------\t------\t-----\t---------")
+
+	// Print results
+	for _, result := range results {
+		metricName := result.MetricName
+		labelStr := formatLabels(result.Labels)
+		timestamp := time.UnixMilli(result.Timestamp).Format("15:04:05")
+
+		fmt.Fprintf(w, "%s\t%s\t%.6f\t%s\n",
+			metricName, labelStr, result.Value, timestamp)
+	}
+}
+
+// formatLabels formats labels, excluding __name__, as {name=value,...} sorted by name
+func formatLabels(lbls map[string]string) string {
+	labelPairs := make([]string, 0, len(lbls))
+	for k, v := range lbls {
+		if k != "__name__" {
+			labelPairs = append(labelPairs, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	sort.Strings(labelPairs)
+	return "{" + strings.Join(labelPairs, ",") + "}"
+}
+
+// displayAnnotations outputs the warnings and info annotations of a query
+func displayAnnotations(result *QueryResult) {
+	if len(result.Warnings) > 0 {
+		fmt.Printf("\nWarnings:\n")
+		for _, warning := range result.Warnings {
+			fmt.Printf("  - %s\n", warning)
+		}
+	}
+	if len(result.Infos) > 0 {
+		fmt.Printf("\nInfo:\n")
+		for _, info := range result.Infos {
+			fmt.Printf("  - %s\n", info)
+		}
+	}
+}
+
+// displayExplanation outputs the parsed query, selector matches and engine statistics
+func displayExplanation(explanation *QueryExplanation) {
+	fmt.Printf("\nParsed expression:\n%s", explanation.Tree)
+
+	fmt.Printf("\nSelectors:\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "SELECTOR\tSERIES")
+	fmt.Fprintln(w, "--------\t------")
+	for _, selector := range explanation.Selectors {
+		fmt.Fprintf(w, "%s\t%d\n", selector.Selector, selector.Series)
+	}
+	w.Flush()
+
+	timings := explanation.Stats.Timings
+	fmt.Printf("\nEngine statistics:\n")
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "Total queryable samples\t%d\n", explanation.Stats.Samples.TotalQueryableSamples)
+	fmt.Fprintf(w, "Peak samples\t%d\n", explanation.Stats.Samples.PeakSamples)
+	fmt.Fprintf(w, "Queue time\t%s\n", secondsToDuration(timings.ExecQueueTime))
+	fmt.Fprintf(w, "Prepare time\t%s\n", secondsToDuration(timings.QueryPreparationTime))
+	fmt.Fprintf(w, "Inner eval time\t%s\n", secondsToDuration(timings.InnerEvalTime))
+	fmt.Fprintf(w, "Result sort time\t%s\n", secondsToDuration(timings.ResultSortTime))
+	fmt.Fprintf(w, "Eval total time\t%s\n", secondsToDuration(timings.EvalTotalTime))
+	fmt.Fprintf(w, "Exec total time\t%s\n", secondsToDuration(timings.ExecTotalTime))
+	w.Flush()
+
+	if steps := explanation.Stats.Samples.TotalQueryableSamplesPerStep; len(steps) > 0 {
+		fmt.Printf("\nSamples per step:\n")
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "STEP\tSAMPLES")
+		fmt.Fprintln(w, "----\t-------")
+		for _, step := range steps {
+			fmt.Fprintf(w, "%s\t%d\n", time.UnixMilli(step.T).Format("15:04:05"), step.V)
+		}
+		w.Flush()
+	}
+}
+
+// displayTargets outputs the scrape status of each target in the requested format
+func displayTargets(format string, targets []TargetStatus) error {
+	if format == outputJSON {
+		return writeJSON(os.Stdout, targets)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "TARGET\tHEALTH\tURL\tLABELS\tLAST SCRAPE\tDURATION\tSAMPLES\tRETRIES\tERROR")
+	fmt.Fprintln(w, "------\t------\t---\t------\t-----------\t--------\t-------\t-------\t-----")
+	for _, target := range targets {
+		lastError := target.LastError
+		if target.ErrorKind != "" {
+			// Keep the table to a line per target
+			lastError, _, _ = strings.Cut(lastError, "\n")
+			lastError = target.ErrorKind + ": " + lastError
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			target.Name, target.Health, target.ScrapeURL, formatLabels(target.Labels),
+			target.LastScrape.Format("15:04:05"), target.Duration.Round(time.Millisecond),
+			target.Samples, target.Retries, lastError)
+	}
+	return nil
+}
+
+// secondsToDuration converts engine timings reported in seconds to a duration
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// displayMetrics prints the metric names in the store with their metadata
+func displayMetrics(format string, metrics []MetricInfo) error {
+	if format == outputJSON {
+		return writeJSON(os.Stdout, metrics)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "METRIC\tTYPE\tUNIT\tSERIES\tTARGETS\tLABELS\tHELP")
+	fmt.Fprintln(w, "------\t----\t----\t------\t-------\t------\t----")
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			metric.Name, metric.Type, metric.Unit, metric.Series,
+			strings.Join(metric.Targets, ","), strings.Join(metric.LabelNames, ","), metric.Help)
+	}
+	return nil
+}
+
+// displayCardinality prints each list of a cardinality report as a table
+func displayCardinality(format string, report CardinalityReport) error {
+	if format == outputJSON {
+		return writeJSON(os.Stdout, report)
+	}
+
+	fmt.Printf("Series: %d\n", report.HeadStats.NumSeries)
+	fmt.Printf("Label pairs: %d\n", report.HeadStats.NumLabelPairs)
+
+	sections := []struct {
+		title, name, value string
+		stats              []CardinalityStat
+	}{
+		{"Top metric names by series count", "METRIC", "SERIES", report.SeriesCountByMetricName},
+		{"Top label names by value count", "LABEL", "VALUES", report.LabelValueCountByLabelName},
+		{"Top label=value pairs by series count", "LABEL PAIR", "SERIES", report.SeriesCountByLabelValuePair},
+		{"Top metric names by memory", "METRIC", "BYTES", report.MemoryInBytesByMetricName},
+	}
+	for _, section := range sections {
+		fmt.Printf("\n%s:\n", section.title)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintf(w, "%s\t%s\n", section.name, section.value)
+		fmt.Fprintf(w, "%s\t%s\n", strings.Repeat("-", len(section.name)), strings.Repeat("-", len(section.value)))
+		for _, stat := range section.stats {
+			fmt.Fprintf(w, "%s\t%d\n", stat.Name, stat.Value)
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+// displayAlerts prints each pending or firing alert with its labels and annotations
+func displayAlerts(format string, alerts []AlertInfo) error {
+	if format == outputJSON {
+		return writeJSON(os.Stdout, alerts)
+	}
+
+	if len(alerts) == 0 {
+		fmt.Println("No alerts are firing or pending")
+		return nil
+	}
+
+	for _, alert := range alerts {
+		fmt.Printf("\n[%s] %s %s\n", strings.ToUpper(alert.State), alert.Name, formatLabels(alert.Labels))
+		fmt.Printf("  Active since: %s\n", alert.ActiveAt.Format(time.RFC3339))
+		fmt.Printf("  Value: %g\n", alert.Value)
+		for _, name := range sortedKeys(alert.Annotations) {
+			fmt.Printf("  %s: %s\n", name, alert.Annotations[name])
+		}
+	}
+	return nil
+}
@@ -3,26 +3,42 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"os"
 	"sort"
 	"sync"
 	"time"
 
 	dto "github.com/prometheus/client_model/go"
-	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
-	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/util/annotations"
+	"github.com/prometheus/prometheus/util/logging"
 )
 
+// defaultSubqueryStep is the step of subqueries that omit one, such as
+// rate(x[5m])[30m:]. Prometheus uses its global evaluation interval, which
+// defaults to one minute.
+const defaultSubqueryStep = time.Minute
+
 // MetricResult represents a single metric result
 type MetricResult struct {
-	MetricName string
-	Labels     map[string]string
-	Value      float64
-	Timestamp  int64
+	MetricName string            `json:"metric"`
+	Labels     map[string]string `json:"labels"`
+	Value      float64           `json:"value"`
+	Timestamp  int64             `json:"timestamp"`
+}
+
+// QueryResult holds the results of a PromQL query together with the
+// warning and info annotations raised by the engine and the storage
+type QueryResult struct {
+	Name     string         `json:"name,omitempty"`
+	Query    string         `json:"query"`
+	Results  []MetricResult `json:"results"`
+	Warnings []string       `json:"warnings,omitempty"`
+	Infos    []string       `json:"infos,omitempty"`
 }
 
 // MetricStore is the in-memory time-series database
@@ -31,18 +47,14 @@ type MetricStore struct {
 	series  map[string]*TimeSeries
 	engine  *promql.Engine
 	storage *InMemoryStorage
-}
 
-// TimeSeries represents a single time series with its samples
-type TimeSeries struct {
-	SeriesLabels labels.Labels
-	Samples      []Sample
-}
+	queryLogger *logging.JSONFileLogger
+	
+	// targets holds the last scrape status of each target by name
+	targets map[string]TargetStatus
 
-// Sample represents a single data point
-type Sample struct {
-	Timestamp int64
-	Value     float64
+	// metadata holds the metadata of each metric name by target
+	metadata map[string]map[string]MetricMetadata
 }
 
 // InMemoryStorage implements storage.Storage interface
@@ -59,75 +71,158 @@ type InMemoryQuerier struct {
 
 // InMemorySeriesSet implements storage.SeriesSet interface
 type InMemorySeriesSet struct {
-	series  []*TimeSeries
-	current int
+	series   []*TimeSeries
+	current  int
+	warnings annotations.Annotations
+}
+
+// EngineOptions holds the PromQL engine settings for a MetricStore
+type EngineOptions struct {
+	LookbackDelta               time.Duration
+	MaxSamples                  int
+	Timeout                     time.Duration
+	EnableAtModifier            bool
+	EnableNegativeOffset        bool
+	EnableExperimentalFunctions bool
+
+	// QueryLogFile, when set, receives a JSON line for every executed query
+	QueryLogFile string
+
+	// ActiveQueryDir, when set, enables the active query tracker which records
+	// in-flight queries there and limits them to MaxConcurrentQueries
+	ActiveQueryDir       string
+	MaxConcurrentQueries int
+}
+
+// DefaultEngineOptions returns the engine settings used when none are given
+func DefaultEngineOptions() EngineOptions {
+	return EngineOptions{
+		LookbackDelta:        5 * time.Minute,
+		MaxSamples:           50000000,
+		Timeout:              5 * time.Minute,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+		MaxConcurrentQueries: 20,
+	}
 }
 
-// InMemorySeriesIterator implements chunkenc.Iterator interface
-type InMemorySeriesIterator struct {
-	samples []Sample
-	current int
+// validate checks the engine settings, including that the active query
+// directory can be written, which the engine would otherwise panic on
+func (o EngineOptions) validate() error {
+	switch {
+	case o.LookbackDelta < 0:
+		return fmt.Errorf("lookback delta must not be negative, got %s", o.LookbackDelta)
+	case o.MaxSamples < 1:
+		return fmt.Errorf("max samples must be positive, got %d", o.MaxSamples)
+	case o.Timeout <= 0:
+		return fmt.Errorf("query timeout must be positive, got %s", o.Timeout)
+	}
+	if o.ActiveQueryDir == "" {
+		return nil
+	}
+
+	if o.MaxConcurrentQueries < 1 {
+		return fmt.Errorf("query max concurrency must be positive, got %d", o.MaxConcurrentQueries)
+	}
+	if err := os.MkdirAll(o.ActiveQueryDir, 0o777); err != nil {
+		return fmt.Errorf("creating active query directory: %w", err)
+	}
+	f, err := os.CreateTemp(o.ActiveQueryDir, "queries.active.*")
+	if err != nil {
+		return fmt.Errorf("active query directory %s is not writable: %w", o.ActiveQueryDir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
 
 // NewMetricStore creates a new in-memory metric store with PromQL engine
-func NewMetricStore() *MetricStore {
+func NewMetricStore(opts EngineOptions) (*MetricStore, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	store := &MetricStore{
-		series: make(map[string]*TimeSeries),
+		series:   make(map[string]*TimeSeries),
+		targets:  make(map[string]TargetStatus),
+		metadata: make(map[string]map[string]MetricMetadata),
 	}
 	
 	// Create storage wrapper
 	store.storage = &InMemoryStorage{store: store}
 	
 	// Create PromQL engine
-	opts := promql.EngineOpts{
-		MaxSamples:    50000000,
-		Timeout:       5 * time.Minute,
-		LookbackDelta: 5 * time.Minute,
+	engineOpts := promql.EngineOpts{
+		MaxSamples:           opts.MaxSamples,
+		Timeout:              opts.Timeout,
+		LookbackDelta:        opts.LookbackDelta,
+		EnableAtModifier:     opts.EnableAtModifier,
+		EnableNegativeOffset: opts.EnableNegativeOffset,
+		EnablePerStepStats:   true,
+		NoStepSubqueryIntervalFn: func(int64) int64 {
+			return defaultSubqueryStep.Milliseconds()
+		},
+	}
+	if opts.ActiveQueryDir != "" {
+		engineOpts.ActiveQueryTracker = promql.NewActiveQueryTracker(opts.ActiveQueryDir, opts.MaxConcurrentQueries, slog.Default())
 	}
-	store.engine = promql.NewEngine(opts)
+	store.engine = promql.NewEngine(engineOpts)
 	
-	return store
+	if opts.QueryLogFile != "" {
+		queryLogger, err := logging.NewJSONFileLogger(opts.QueryLogFile)
+		if err != nil {
+			store.engine.Close()
+			return nil, fmt.Errorf("opening query log file: %w", err)
+		}
+		store.queryLogger = queryLogger
+		store.engine.SetQueryLogger(queryLogger)
+	}
+	
+	return store, nil
+}
+
+// Close releases the query log file and active query tracker
+func (s *MetricStore) Close() error {
+	if s.queryLogger != nil {
+		s.queryLogger.Close()
+	}
+	return s.engine.Close()
 }
 
-// AddMetricFamilies adds metric families to the store
-func (s *MetricStore) AddMetricFamilies(families map[string]*dto.MetricFamily) {
+// AddMetricFamilies adds metric families scraped from target to the store,
+// adding targetLabels to every series. Like Prometheus, a scraped label that
+// clashes with a target label is kept as exported_<name>.
+func (s *MetricStore) AddMetricFamilies(target string, targetLabels labels.Labels, families map[string]*dto.MetricFamily) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	
 	timestamp := time.Now().UnixMilli()
 	
 	for metricName, family := range families {
+		s.setMetadata(metricName, target, familyMetadata(family))
+		
 		for _, metric := range family.Metric {
 			// Create labels for this metric
-			lbls := make(labels.Labels, 0, len(metric.Label)+1)
+			lbls := make(labels.Labels, 0, len(metric.Label)+len(targetLabels)+1)
 			lbls = append(lbls, labels.Label{Name: "__name__", Value: metricName})
 			
 			// Add metric labels
 			for _, label := range metric.Label {
+				name := label.GetName()
+				if targetLabels.Has(name) {
+					name = "exported_" + name
+				}
 				lbls = append(lbls, labels.Label{
-					Name:  label.GetName(),
+					Name:  name,
 					Value: label.GetValue(),
 				})
 			}
+			lbls = append(lbls, targetLabels...)
 			
 			// Sort labels for consistent series identification
 			sort.Slice(lbls, func(i, j int) bool {
 				return lbls[i].Name < lbls[j].Name
 			})
 			
-			// Create series key
-			seriesKey := lbls.String()
-			
-			// Get or create time series
-			series, exists := s.series[seriesKey]
-			if !exists {
-				series = &TimeSeries{
-					SeriesLabels: lbls,
-					Samples:      make([]Sample, 0),
-				}
-				s.series[seriesKey] = series
-			}
-			
 			// Extract value based on metric type
 			var value float64
 			switch family.GetType() {
@@ -153,22 +248,49 @@ func (s *MetricStore) AddMetricFamilies(families map[string]*dto.MetricFamily) {
 				}
 			}
 			
-			// Add sample to series
-			series.Samples = append(series.Samples, Sample{
-				Timestamp: timestamp,
-				Value:     value,
-			})
-			
-			// Keep only last 1000 samples per series to limit memory usage
-			if len(series.Samples) > 1000 {
-				series.Samples = series.Samples[len(series.Samples)-1000:]
-			}
+			s.appendSample(lbls, timestamp, value)
 		}
 	}
 }
 
-// ExecutePromQL executes a PromQL query and returns results
-func (s *MetricStore) ExecutePromQL(ctx context.Context, query string) ([]MetricResult, error) {
+// AddSamples adds the float samples of an evaluated vector, such as the output
+// of a recording rule, to the store. Histogram samples are skipped since
+// series only hold floats.
+func (s *MetricStore) AddSamples(vector promql.Vector) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	for _, sample := range vector {
+		if sample.H != nil {
+			continue
+		}
+		s.appendSample(sample.Metric, sample.T, sample.F)
+	}
+}
+
+// appendSample appends a sample to the series with the given sorted labels,
+// creating the series if needed. The caller must hold the store mutex.
+func (s *MetricStore) appendSample(lbls labels.Labels, t int64, v float64) {
+	// Create series key
+	seriesKey := lbls.String()
+	
+	// Get or create time series
+	series, exists := s.series[seriesKey]
+	if !exists {
+		series = newTimeSeries(lbls)
+		s.series[seriesKey] = series
+	}
+	
+	series.append(t, v)
+}
+
+// ExecutePromQL executes a PromQL query at the current time and returns results
+func (s *MetricStore) ExecutePromQL(ctx context.Context, query string) (*QueryResult, error) {
+	return s.ExecutePromQLAt(ctx, query, time.Now())
+}
+
+// ExecutePromQLAt executes a PromQL query evaluated at ts and returns results
+func (s *MetricStore) ExecutePromQLAt(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
 	// Validate the query first
 	_, err := parser.ParseExpr(query)
 	if err != nil {
@@ -176,19 +298,49 @@ func (s *MetricStore) ExecutePromQL(ctx context.Context, query string) ([]Metric
 	}
 	
 	// Execute the query using the Prometheus engine
-	q, err := s.engine.NewInstantQuery(ctx, s.storage, nil, query, time.Now())
+	q, result, err := s.instantQuery(ctx, query, ts, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create query: %w", err)
+		return nil, err
 	}
 	defer q.Close()
 	
+	return s.newQueryResult(query, *result)
+}
+
+// newQueryResult converts an engine result into a QueryResult, splitting its
+// annotations into warnings and infos
+func (s *MetricStore) newQueryResult(query string, result promql.Result) (*QueryResult, error) {
+	results, err := s.convertPromQLResult(result)
+	if err != nil {
+		return nil, err
+	}
+	
+	warnings, infos := result.Warnings.AsStrings(query, 0, 0)
+	sort.Strings(warnings)
+	sort.Strings(infos)
+	
+	return &QueryResult{
+		Query:    query,
+		Results:  results,
+		Warnings: warnings,
+		Infos:    infos,
+	}, nil
+}
+
+// instantQuery evaluates query at ts. On success the caller must close the
+// returned query once it is done with the result and query statistics.
+func (s *MetricStore) instantQuery(ctx context.Context, query string, ts time.Time, opts promql.QueryOpts) (promql.Query, *promql.Result, error) {
+	q, err := s.engine.NewInstantQuery(ctx, s.storage, opts, query, ts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create query: %w", err)
+	}
+	
 	result := q.Exec(ctx)
 	if result.Err != nil {
-		return nil, fmt.Errorf("query execution failed: %w", result.Err)
+		q.Close()
+		return nil, nil, fmt.Errorf("query execution failed: %w", result.Err)
 	}
-	
-	// Convert result to MetricResult slice
-	return s.convertPromQLResult(*result)
+	return q, result, nil
 }
 
 // convertPromQLResult converts Prometheus query result to MetricResult slice
@@ -275,24 +427,15 @@ func (q *InMemoryQuerier) Select(ctx context.Context, sortSeries bool, hints *st
 	
 	for _, series := range q.store.series {
 		if q.matchesLabels(series.SeriesLabels, matchers) {
-			// Filter samples by time range
-			filteredSeries := &TimeSeries{
-				SeriesLabels: series.SeriesLabels,
-				Samples:      make([]Sample, 0),
-			}
-			
-			for _, sample := range series.Samples {
-				if sample.Timestamp >= q.mint && sample.Timestamp <= q.maxt {
-					filteredSeries.Samples = append(filteredSeries.Samples, sample)
-				}
-			}
-			
-			if len(filteredSeries.Samples) > 0 {
-				matchingSeries = append(matchingSeries, filteredSeries)
+			// Share the chunks covering the time range instead of decoding them
+			if view := series.view(q.mint, q.maxt); view != nil {
+				matchingSeries = append(matchingSeries, view)
 			}
 		}
 	}
 	
+	recordSelect(ctx, matchers, len(matchingSeries))
+	
 	if sortSeries {
 		sort.Slice(matchingSeries, func(i, j int) bool {
 			return labels.Compare(matchingSeries[i].SeriesLabels, matchingSeries[j].SeriesLabels) < 0
@@ -300,8 +443,9 @@ func (q *InMemoryQuerier) Select(ctx context.Context, sortSeries bool, hints *st
 	}
 	
 	return &InMemorySeriesSet{
-		series:  matchingSeries,
-		current: -1,
+		series:   matchingSeries,
+		current:  -1,
+		warnings: q.store.storageWarnings(),
 	}
 }
 
@@ -336,7 +480,7 @@ func (q *InMemoryQuerier) LabelValues(ctx context.Context, name string, hints *s
 	}
 	
 	sort.Strings(values)
-	return values, nil, nil
+	return values, q.store.storageWarnings(), nil
 }
 
 func (q *InMemoryQuerier) LabelNames(ctx context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
@@ -359,7 +503,7 @@ func (q *InMemoryQuerier) LabelNames(ctx context.Context, hints *storage.LabelHi
 	}
 	
 	sort.Strings(names)
-	return names, nil, nil
+	return names, q.store.storageWarnings(), nil
 }
 
 func (q *InMemoryQuerier) Close() error {
@@ -384,64 +528,5 @@ func (s *InMemorySeriesSet) Err() error {
 }
 
 func (s *InMemorySeriesSet) Warnings() annotations.Annotations {
-	return nil
-}
-
-// TimeSeries implements storage.Series interface
-func (ts *TimeSeries) Labels() labels.Labels {
-	return ts.SeriesLabels
-}
-
-func (ts *TimeSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
-	return &InMemorySeriesIterator{
-		samples: ts.Samples,
-		current: -1,
-	}
-}
-
-// SeriesIterator interface implementation
-func (it *InMemorySeriesIterator) Next() chunkenc.ValueType {
-	it.current++
-	if it.current >= len(it.samples) {
-		return chunkenc.ValNone
-	}
-	return chunkenc.ValFloat
-}
-
-func (it *InMemorySeriesIterator) Seek(t int64) chunkenc.ValueType {
-	for i, sample := range it.samples {
-		if sample.Timestamp >= t {
-			it.current = i
-			return chunkenc.ValFloat
-		}
-	}
-	it.current = len(it.samples)
-	return chunkenc.ValNone
-}
-
-func (it *InMemorySeriesIterator) At() (int64, float64) {
-	if it.current < 0 || it.current >= len(it.samples) {
-		return 0, 0
-	}
-	sample := it.samples[it.current]
-	return sample.Timestamp, sample.Value
+	return s.warnings
 }
-
-func (it *InMemorySeriesIterator) AtHistogram(h *histogram.Histogram) (int64, *histogram.Histogram) {
-	return 0, nil
-}
-
-func (it *InMemorySeriesIterator) AtFloatHistogram(fh *histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
-	return 0, nil
-}
-
-func (it *InMemorySeriesIterator) AtT() int64 {
-	if it.current < 0 || it.current >= len(it.samples) {
-		return 0
-	}
-	return it.samples[it.current].Timestamp
-}
-
-func (it *InMemorySeriesIterator) Err() error {
-	return nil
-}
\ No newline at end of file
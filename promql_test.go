@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/prometheus/prometheus/storage"
+)
+
+var (
+	loadPattern = regexp.MustCompile(`^load\s+(\S+)$`)
+	evalPattern = regexp.MustCompile(`^eval\s+instant\s+at\s+(\S+)\s+(.+)$`)
+)
+
+// conformanceFile is a golden PromQL test file in testdata/promql. It uses the
+// promqltest format, restricted to load commands and eval instant commands
+// without expected results, since the expected results are those of the
+// upstream promqltest storage holding the same series.
+type conformanceFile struct {
+	loads []ruleTestCase
+	evals []conformanceEval
+}
+
+// conformanceEval is a query evaluated at a time offset from the test epoch
+type conformanceEval struct {
+	line int
+	at   time.Duration
+	expr string
+}
+
+// parseConformanceFile parses a golden PromQL test file
+func parseConformanceFile(data string) (*conformanceFile, error) {
+	file := &conformanceFile{}
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if m := loadPattern.FindStringSubmatch(line); m != nil {
+			interval, err := model.ParseDuration(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid load interval: %w", i+1, err)
+			}
+			load := ruleTestCase{Interval: interval}
+			for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+				i++
+				load.InputSeries = append(load.InputSeries, inputSeries{Series: strings.TrimSpace(lines[i])})
+			}
+			file.loads = append(file.loads, load)
+			continue
+		}
+
+		if m := evalPattern.FindStringSubmatch(line); m != nil {
+			at, err := model.ParseDuration(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid eval time: %w", i+1, err)
+			}
+			file.evals = append(file.evals, conformanceEval{line: i + 1, at: time.Duration(at), expr: m[2]})
+			continue
+		}
+
+		return nil, fmt.Errorf("line %d: unsupported command %q", i+1, line)
+	}
+	return file, nil
+}
+
+// promqltestInput returns the load commands of the file in promqltest syntax
+func (f *conformanceFile) promqltestInput() string {
+	var b strings.Builder
+	for _, load := range f.loads {
+		fmt.Fprintf(&b, "load %s\n", load.Interval)
+		for _, series := range load.InputSeries {
+			fmt.Fprintf(&b, "  %s\n", series.Series)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// TestPromQLConformance loads the series of every testdata/promql file into a
+// MetricStore and into the upstream promqltest storage, and checks that every
+// query returns the same results from both
+func TestPromQLConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "promql", "*.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no PromQL test files found")
+	}
+
+	for _, path := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".test"), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := parseConformanceFile(string(data))
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+
+			store := newTestStore(t)
+			for _, load := range file.loads {
+				if err := load.loadInputSeries(store); err != nil {
+					t.Fatalf("%s: %v", path, err)
+				}
+			}
+			upstream := promqltest.LoadedStorage(t, file.promqltestInput())
+			t.Cleanup(func() { upstream.Close() })
+
+			for _, eval := range file.evals {
+				got, err := store.ExecutePromQLAt(context.Background(), eval.expr, testTime(eval.at))
+				if err != nil {
+					t.Errorf("%s:%d: %s: %v", path, eval.line, eval.expr, err)
+					continue
+				}
+				want, err := upstreamQuery(store, upstream, eval)
+				if err != nil {
+					t.Errorf("%s:%d: %s: upstream: %v", path, eval.line, eval.expr, err)
+					continue
+				}
+				if diff := diffQueryResults(got, want); diff != "" {
+					t.Errorf("%s:%d: %s at %s differs from upstream:\n%s", path, eval.line, eval.expr, model.Duration(eval.at), diff)
+				}
+			}
+		})
+	}
+}
+
+// upstreamQuery evaluates eval with the engine of store against the upstream
+// storage, so the storage is the only difference between the two results
+func upstreamQuery(store *MetricStore, upstream storage.Storage, eval conformanceEval) (*QueryResult, error) {
+	ctx := context.Background()
+	q, err := store.engine.NewInstantQuery(ctx, upstream, nil, eval.expr, testTime(eval.at))
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	result := q.Exec(ctx)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return store.newQueryResult(eval.expr, *result)
+}
+
+// diffQueryResults describes the differences between two query results, or
+// returns an empty string when they match
+func diffQueryResults(got, want *QueryResult) string {
+	gotSamples := resultSamples(got)
+	wantSamples := resultSamples(want)
+
+	var diffs []string
+	for _, lbls := range sortedKeys(wantSamples) {
+		gotSample, ok := gotSamples[lbls]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("  missing %s %g", lbls, wantSamples[lbls].Value))
+		case gotSample.Timestamp != wantSamples[lbls].Timestamp || !almostEqual(gotSample.Value, wantSamples[lbls].Value):
+			diffs = append(diffs, fmt.Sprintf("  %s: got %g @ %d, want %g @ %d",
+				lbls, gotSample.Value, gotSample.Timestamp, wantSamples[lbls].Value, wantSamples[lbls].Timestamp))
+		}
+	}
+	for _, lbls := range sortedKeys(gotSamples) {
+		if _, ok := wantSamples[lbls]; !ok {
+			diffs = append(diffs, fmt.Sprintf("  unexpected %s %g", lbls, gotSamples[lbls].Value))
+		}
+	}
+
+	if !equalStrings(got.Warnings, want.Warnings) {
+		diffs = append(diffs, fmt.Sprintf("  warnings: got %q, want %q", got.Warnings, want.Warnings))
+	}
+	if !equalStrings(got.Infos, want.Infos) {
+		diffs = append(diffs, fmt.Sprintf("  infos: got %q, want %q", got.Infos, want.Infos))
+	}
+	return strings.Join(diffs, "\n")
+}
+
+// resultSamples returns the results of a query keyed by their labels
+func resultSamples(result *QueryResult) map[string]MetricResult {
+	samples := make(map[string]MetricResult, len(result.Results))
+	for _, r := range result.Results {
+		samples[labels.FromMap(r.Labels).String()] = r
+	}
+	return samples
+}
+
+// equalStrings reports whether a and b hold the same strings in any order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// newEngineTestStore returns a store with opts holding test_metric with a
+// sample every 15 seconds over the first ten minutes after the test epoch
+func newEngineTestStore(t *testing.T, opts EngineOptions) *MetricStore {
+	t.Helper()
+
+	store, err := NewMetricStore(opts)
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	lbls := labels.FromStrings(labels.MetricName, "test_metric", "job", "test")
+	for i := range 41 {
+		store.appendSample(lbls, testTime(time.Duration(i)*15*time.Second).UnixMilli(), float64(i))
+	}
+	return store
+}
+
+func TestEngineOptions(t *testing.T) {
+	end := testTime(10 * time.Minute)
+	tests := []struct {
+		name    string
+		opts    func(*EngineOptions)
+		query   string
+		at      time.Time
+		want    int
+		wantErr string
+	}{
+		{"default lookback", nil, "test_metric", end.Add(4 * time.Minute), 1, ""},
+		{"short lookback", func(o *EngineOptions) { o.LookbackDelta = time.Minute }, "test_metric", end.Add(2 * time.Minute), 0, ""},
+		{"short lookback within range", func(o *EngineOptions) { o.LookbackDelta = time.Minute }, "test_metric", end.Add(30 * time.Second), 1, ""},
+		{"max samples", func(o *EngineOptions) { o.MaxSamples = 10 }, "sum_over_time(test_metric[10m])", end, 0, "too many samples"},
+		{"max samples enough", func(o *EngineOptions) { o.MaxSamples = 100 }, "sum_over_time(test_metric[10m])", end, 1, ""},
+		{"timeout", func(o *EngineOptions) { o.Timeout = time.Nanosecond }, "sum_over_time(test_metric[10m])", end, 0, "timed out"},
+		{"@ modifier", nil, "test_metric @ 60", end, 1, ""},
+		{"@ modifier disabled", func(o *EngineOptions) { o.EnableAtModifier = false }, "test_metric @ 60", end, 0, "@ modifier is disabled"},
+		{"negative offset", nil, "test_metric offset -1m", end.Add(-5 * time.Minute), 1, ""},
+		{"negative offset disabled", func(o *EngineOptions) { o.EnableNegativeOffset = false }, "test_metric offset -1m", end, 0, "negative offset is disabled"},
+	}
+	for _, tt := range tests {
+		opts := DefaultEngineOptions()
+		if tt.opts != nil {
+			tt.opts(&opts)
+		}
+		store := newEngineTestStore(t, opts)
+
+		result, err := store.ExecutePromQLAt(context.Background(), tt.query, tt.at)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: %s = %v, want an error containing %q", tt.name, tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s: %v", tt.name, tt.query, err)
+			continue
+		}
+		if len(result.Results) != tt.want {
+			t.Errorf("%s: %s returned %d results, want %d", tt.name, tt.query, len(result.Results), tt.want)
+		}
+	}
+}
+
+func TestEngineOptionsQueryLog(t *testing.T) {
+	opts := DefaultEngineOptions()
+	opts.QueryLogFile = filepath.Join(t.TempDir(), "query.log")
+	store := newEngineTestStore(t, opts)
+
+	if _, err := store.ExecutePromQLAt(context.Background(), "sum(test_metric)", testTime(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(opts.QueryLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"query":"sum(test_metric)"`) {
+		t.Errorf("query log does not hold the query:\n%s", data)
+	}
+}
+
+func TestEngineOptionsActiveQueryTracker(t *testing.T) {
+	opts := DefaultEngineOptions()
+	opts.ActiveQueryDir = filepath.Join(t.TempDir(), "active")
+	opts.MaxConcurrentQueries = 2
+	store := newEngineTestStore(t, opts)
+
+	if _, err := store.ExecutePromQLAt(context.Background(), "test_metric", testTime(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(opts.ActiveQueryDir, "queries.active")); err != nil {
+		t.Errorf("active query log not created: %v", err)
+	}
+}
+
+func TestEngineOptionsValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    func(*EngineOptions)
+		wantErr string
+	}{
+		{"defaults", nil, ""},
+		{"negative lookback", func(o *EngineOptions) { o.LookbackDelta = -time.Minute }, "lookback delta"},
+		{"no samples", func(o *EngineOptions) { o.MaxSamples = 0 }, "max samples"},
+		{"no timeout", func(o *EngineOptions) { o.Timeout = 0 }, "query timeout"},
+		{"no concurrency without tracker", func(o *EngineOptions) { o.MaxConcurrentQueries = 0 }, ""},
+		{"no concurrency", func(o *EngineOptions) {
+			o.ActiveQueryDir = t.TempDir()
+			o.MaxConcurrentQueries = 0
+		}, "query max concurrency"},
+		{"directory under a file", func(o *EngineOptions) { o.ActiveQueryDir = filepath.Join(file, "active") }, "active query directory"},
+	}
+	for _, tt := range tests {
+		opts := DefaultEngineOptions()
+		if tt.opts != nil {
+			tt.opts(&opts)
+		}
+		store, err := NewMetricStore(opts)
+		if err == nil {
+			store.Close()
+		}
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: NewMetricStore = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyEngineFlagsExperimentalFunctions(t *testing.T) {
+	t.Cleanup(func() { parser.EnableExperimentalFunctions = false })
+
+	const query = `sort_by_label(test_metric, "job")`
+	opts := DefaultEngineOptions()
+	store := newEngineTestStore(t, opts)
+
+	// Creating a store leaves the parser alone
+	parser.EnableExperimentalFunctions = false
+	if _, err := store.ExecutePromQLAt(context.Background(), query, testTime(10*time.Minute)); err == nil {
+		t.Errorf("%s succeeded with experimental functions disabled", query)
+	}
+
+	opts.EnableExperimentalFunctions = true
+	if err := applyEngineFlags(opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ExecutePromQLAt(context.Background(), query, testTime(10*time.Minute)); err != nil {
+		t.Errorf("%s with experimental functions enabled: %v", query, err)
+	}
+}
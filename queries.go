@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NamedQuery is a PromQL query together with the name its results are grouped under
+type NamedQuery struct {
+	Name  string `yaml:"name"`
+	Query string `yaml:"query"`
+}
+
+// queryFile is the YAML layout accepted by -query-file
+type queryFile struct {
+	Queries []NamedQuery `yaml:"queries"`
+}
+
+// queryFlags collects the values of a repeatable -query flag
+type queryFlags []string
+
+func (q *queryFlags) String() string {
+	return strings.Join(*q, ", ")
+}
+
+func (q *queryFlags) Set(value string) error {
+	*q = append(*q, value)
+	return nil
+}
+
+// namedQueries returns the -query values as queries named after their expression
+func (q queryFlags) namedQueries() []NamedQuery {
+	queries := make([]NamedQuery, 0, len(q))
+	for _, query := range q {
+		queries = append(queries, NamedQuery{Name: query, Query: query})
+	}
+	return queries
+}
+
+// loadQueryFile reads named queries from a YAML file (.yaml or .yml) or from a
+// plain-text file with one query per line. Blank lines and lines starting with
+// # are ignored in plain-text files, and each query is named after itself.
+func loadQueryFile(path string) ([]NamedQuery, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading query file: %w", err)
+	}
+
+	var queries []NamedQuery
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		queries, err = parseYAMLQueries(data)
+	default:
+		queries, err = parseTextQueries(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkQueryNames(queries); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return queries, nil
+}
+
+// checkQueryNames rejects queries sharing a name, since results are grouped
+// and reported by name
+func checkQueryNames(queries []NamedQuery) error {
+	seen := make(map[string]bool, len(queries))
+	for _, query := range queries {
+		if seen[query.Name] {
+			return fmt.Errorf("duplicate query name %q", query.Name)
+		}
+		seen[query.Name] = true
+	}
+	return nil
+}
+
+// parseYAMLQueries parses a `queries:` list of name/query pairs
+func parseYAMLQueries(data []byte) ([]NamedQuery, error) {
+	var file queryFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		// An empty or comment-only file has no document, like an empty text file
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("parsing query file: %w", err)
+	}
+
+	for i, query := range file.Queries {
+		if strings.TrimSpace(query.Query) == "" {
+			return nil, fmt.Errorf("query %d (%q) has no expression", i+1, query.Name)
+		}
+		if query.Name == "" {
+			file.Queries[i].Name = query.Query
+		}
+	}
+	return file.Queries, nil
+}
+
+// parseTextQueries parses one query per line
+func parseTextQueries(data []byte) ([]NamedQuery, error) {
+	var queries []NamedQuery
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		queries = append(queries, NamedQuery{Name: line, Query: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading query file: %w", err)
+	}
+	return queries, nil
+}
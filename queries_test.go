@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadQueryFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    []NamedQuery
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			file: "queries.yaml",
+			data: `queries:
+- name: pods
+  query: kubelet_running_pods
+- query: sum(apiserver_request_total)
+`,
+			want: []NamedQuery{
+				{Name: "pods", Query: "kubelet_running_pods"},
+				{Name: "sum(apiserver_request_total)", Query: "sum(apiserver_request_total)"},
+			},
+		},
+		{
+			name: "yaml duplicate names",
+			file: "queries.yml",
+			data: `queries:
+- name: pods
+  query: kubelet_running_pods
+- name: pods
+  query: kubelet_running_containers
+`,
+			wantErr: `duplicate query name "pods"`,
+		},
+		{
+			name: "yaml missing expression",
+			file: "queries.yaml",
+			data: `queries:
+- name: pods
+`,
+			wantErr: `query 1 ("pods") has no expression`,
+		},
+		{
+			name:    "yaml malformed",
+			file:    "queries.yaml",
+			data:    "queries:\n- name: [pods\n",
+			wantErr: "parsing query file",
+		},
+		{
+			name:    "yaml unknown field",
+			file:    "queries.yaml",
+			data:    "queries:\n- name: pods\n  expr: kubelet_running_pods\n",
+			wantErr: "field expr not found",
+		},
+		{
+			name: "yaml empty",
+			file: "queries.yaml",
+		},
+		{
+			name: "yaml only comments",
+			file: "queries.yml",
+			data: "# queries are added per cluster\n\n",
+		},
+		{
+			name: "text with blank and comment lines",
+			file: "queries.txt",
+			data: `# Pods per node
+kubelet_running_pods
+
+  # indented comment
+  sum(apiserver_request_total)  
+`,
+			want: []NamedQuery{
+				{Name: "kubelet_running_pods", Query: "kubelet_running_pods"},
+				{Name: "sum(apiserver_request_total)", Query: "sum(apiserver_request_total)"},
+			},
+		},
+		{
+			name:    "text duplicate queries",
+			file:    "queries.txt",
+			data:    "kubelet_running_pods\nkubelet_running_pods\n",
+			wantErr: `duplicate query name "kubelet_running_pods"`,
+		},
+		{
+			name: "text only comments",
+			file: "queries.txt",
+			data: "# nothing here\n\n",
+		},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.file)
+		if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := loadQueryFile(path)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: loadQueryFile = %v, want an error containing %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: loadQueryFile = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadQueryFileMissing(t *testing.T) {
+	_, err := loadQueryFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "reading query file") {
+		t.Errorf("loadQueryFile = %v, want a reading error", err)
+	}
+}
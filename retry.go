@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Defaults of the retry policy of every target
+const (
+	defaultScrapeAttempts = 3
+	defaultRetryBackoff   = 250 * time.Millisecond
+	maxRetryBackoff       = 5 * time.Second
+)
+
+// retryPolicy decides how often and how soon a failed scrape of a target is
+// tried again. Only transient failures, as decided by retryable, are retried.
+type retryPolicy struct {
+	// maxAttempts is the number of attempts including the first; a
+	// policy with fewer than two attempts never retries
+	maxAttempts int
+
+	// baseDelay is the backoff before the first retry, doubling with every
+	// further retry up to maxDelay. Half of each backoff is random jitter.
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// retryPolicies holds the retry policy of every target, with overrides by
+// component
+type retryPolicies struct {
+	defaults   retryPolicy
+	components map[string]retryPolicy
+}
+
+// forComponent returns the retry policy of component
+func (p retryPolicies) forComponent(component string) retryPolicy {
+	if policy, ok := p.components[component]; ok {
+		return policy
+	}
+	return p.defaults
+}
+
+// parseRetryPolicies builds the retry policies of the -scrape-attempts,
+// -retry-backoff and -target-attempts flags. targetAttempts is a
+// comma-separated list of component=attempts overrides.
+func parseRetryPolicies(attempts int, backoff time.Duration, targetAttempts string) (retryPolicies, error) {
+	defaults := retryPolicy{maxAttempts: attempts, baseDelay: backoff, maxDelay: maxRetryBackoff}
+	policies := retryPolicies{defaults: defaults, components: make(map[string]retryPolicy)}
+
+	for _, override := range strings.Split(targetAttempts, ",") {
+		if override = strings.TrimSpace(override); override == "" {
+			continue
+		}
+		component, value, ok := strings.Cut(override, "=")
+		if !ok {
+			return retryPolicies{}, fmt.Errorf("invalid target attempts %q, want component=attempts", override)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return retryPolicies{}, fmt.Errorf("invalid attempts %q for %s, want a positive number", value, component)
+		}
+		policy := defaults
+		policy.maxAttempts = n
+		policies.components[strings.TrimSpace(component)] = policy
+	}
+	return policies, nil
+}
+
+// backoff returns the jittered delay before retry n, counting from 1
+func (p retryPolicy) backoff(n int) time.Duration {
+	delay := p.baseDelay
+	for i := 1; i < n && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.maxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// scrape calls scrape until it succeeds, fails with an error that is not
+// retryable, runs out of attempts or ctx is done. It returns the result of
+// the last attempt and the number of retries made; onRetry, when set, is
+// told of every retry before its backoff.
+func (p retryPolicy) scrape(ctx context.Context, scrape func() (*scrapeResult, error),
+	onRetry func(retry int, delay time.Duration, err error)) (*scrapeResult, int, error) {
+	for retries := 0; ; retries++ {
+		result, err := scrape()
+		if err == nil || retries+1 >= p.maxAttempts || !retryable(err) || ctx.Err() != nil {
+			return result, retries, err
+		}
+
+		delay := p.backoff(retries + 1)
+		if onRetry != nil {
+			onRetry(retries+1, delay, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, retries, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a scrape failure is transient: a 429 or a 502,
+// 503 or 504 from the API server, proxy or component, the equivalent API
+// errors of discovery requests, or a connection that was refused, reset,
+// cut short or timed out
+func retryable(err error) bool {
+	var statusErr *scrapeStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	if apierrors.IsTooManyRequests(err) || apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseError is returned by scrapeMetrics for responses that are not in the
+// text exposition format
+type parseError struct {
+	url string
+	err error
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("failed to parse response body from %s: %v", e.url, e.err)
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// scrapeStatusError is returned by scrapeMetrics for responses other than
+// 200 OK
+type scrapeStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Snippet    string
+
+	// Rejection describes a 429 from the API server
+	Rejection string
+}
+
+func (e *scrapeStatusError) Error() string {
+	if e.StatusCode == http.StatusTooManyRequests && e.Rejection != "" {
+		return fmt.Sprintf("failed GET %s: %s", e.URL, e.Rejection)
+	}
+	return fmt.Sprintf("failed GET %s: status code %d (%s)\nResponse snippet: %s",
+		e.URL, e.StatusCode, e.Status, e.Snippet)
+}
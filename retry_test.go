@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRetryPolicies retries every scrape up to three times without waiting
+// more than a millisecond
+func testRetryPolicies(t *testing.T, targetAttempts string) retryPolicies {
+	t.Helper()
+
+	policies, err := parseRetryPolicies(3, time.Millisecond, targetAttempts)
+	if err != nil {
+		t.Fatalf("parseRetryPolicies: %v", err)
+	}
+	return policies
+}
+
+func TestCollectAllMetricsRetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		failures       int
+		status         int
+		targetAttempts string
+		wantHealth     string
+		wantRetries    int
+	}{
+		{name: "recovers", failures: 2, status: http.StatusServiceUnavailable, wantHealth: healthUp, wantRetries: 2},
+		{name: "gateway timeout", failures: 1, status: http.StatusGatewayTimeout, wantHealth: healthUp, wantRetries: 1},
+		{name: "too many requests", failures: 1, status: http.StatusTooManyRequests, wantHealth: healthUp, wantRetries: 1},
+		{name: "attempts run out", failures: 3, status: http.StatusServiceUnavailable, wantHealth: healthDown, wantRetries: 2},
+		{name: "not retryable", failures: 1, status: http.StatusForbidden, wantHealth: healthDown, wantRetries: 0},
+		{name: "target override", failures: 1, status: http.StatusServiceUnavailable, targetAttempts: "kubelet=1",
+			wantHealth: healthDown, wantRetries: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newStandardFakeCluster(t)
+			cluster.serveFlaky(nodeProxyPath("node-a", "metrics"), tt.failures, tt.status, "kubelet.prom")
+			client := cluster.client()
+			client.retries = testRetryPolicies(t, tt.targetAttempts)
+
+			store := newTestStore(t)
+			if err := collectAllMetrics(context.Background(), store, client, false); err != nil {
+				t.Fatalf("collectAllMetrics: %v", err)
+			}
+
+			target := targetsByName(store)["kubelet"]
+			if target.Health != tt.wantHealth || target.Retries != tt.wantRetries {
+				t.Errorf("kubelet health %s after %d retries (%s), want %s after %d",
+					target.Health, target.Retries, target.LastError, tt.wantHealth, tt.wantRetries)
+			}
+			if tt.wantHealth == healthDown && !strings.Contains(target.LastError, http.StatusText(tt.status)) {
+				t.Errorf("last error = %q, want the final %d", target.LastError, tt.status)
+			}
+
+			retries := queryValues(t, store, retriesMetric)
+			if got := retries["{component=kubelet}"]; got != float64(tt.wantRetries) {
+				t.Errorf("%s = %v, want %d", retriesMetric, retries, tt.wantRetries)
+			}
+			if got := retries["{component=apiserver}"]; got != 0 {
+				t.Errorf("apiserver retries = %v, want 0", got)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyConnectionReset(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// Drop the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		w.Write([]byte("up 1\n"))
+	}))
+	defer server.Close()
+
+	policy := testRetryPolicies(t, "").forComponent("apiserver")
+	var retried []string
+	client := &clusterClient{httpClient: server.Client(), host: server.URL}
+	result, retries, err := policy.scrape(context.Background(), func() (*scrapeResult, error) {
+		return client.scrapePath(context.Background(), "/metrics", nil)
+	}, func(retry int, delay time.Duration, err error) {
+		retried = append(retried, err.Error())
+	})
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	if _, ok := result.families["up"]; !ok || retries != 1 || len(retried) != 1 {
+		t.Errorf("got %d families after %d retries (%v), want up after 1 retry", len(result.families), retries, retried)
+	}
+}
+
+func TestRetryPolicyContextDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	policy := retryPolicy{maxAttempts: 10, baseDelay: time.Hour, maxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	client := &clusterClient{httpClient: server.Client(), host: server.URL}
+	_, retries, err := policy.scrape(ctx, func() (*scrapeResult, error) {
+		return client.scrapePath(ctx, "/metrics", nil)
+	}, nil)
+	if err == nil || retries != 0 || !strings.Contains(err.Error(), "503") {
+		t.Errorf("error %v after %d retries, want the 503 once the collection timed out", err, retries)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 10, baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	for retry, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for range 20 {
+			if got := policy.backoff(retry + 1); got < want/2 || got > want {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", retry+1, got, want/2, want)
+			}
+		}
+	}
+}
+
+func TestParseRetryPolicies(t *testing.T) {
+	policies, err := parseRetryPolicies(3, time.Second, "kubelet=5, scheduler=1")
+	if err != nil {
+		t.Fatalf("parseRetryPolicies: %v", err)
+	}
+	for component, want := range map[string]int{"kubelet": 5, "scheduler": 1, "apiserver": 3} {
+		if got := policies.forComponent(component).maxAttempts; got != want {
+			t.Errorf("%s attempts = %d, want %d", component, got, want)
+		}
+	}
+
+	for _, value := range []string{"kubelet", "kubelet=0", "kubelet=many"} {
+		if _, err := parseRetryPolicies(3, time.Second, value); err == nil {
+			t.Errorf("parseRetryPolicies accepted %q", value)
+		}
+	}
+}
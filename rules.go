@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/rules"
+)
+
+// ruleGroup is a group of rules evaluated in order, so later rules can use
+// the series recorded by earlier ones
+type ruleGroup struct {
+	name        string
+	file        string
+	queryOffset time.Duration
+	limit       int
+	rules       []rules.Rule
+}
+
+// loadRules loads the rule files matching the -rules flag, if it is set
+func loadRules(pattern string) ([]*ruleGroup, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return loadRuleFiles(pattern)
+}
+
+// loadRuleFiles loads the rule groups of every file matching pattern, a path
+// or a glob such as rules/*.yaml
+func loadRuleFiles(pattern string) ([]*ruleGroup, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule file pattern %q: %w", pattern, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no rule files match %q", pattern)
+	}
+
+	var groups []*ruleGroup
+	for _, file := range files {
+		fileGroups, err := loadRuleFile(file)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, fileGroups...)
+	}
+	return groups, nil
+}
+
+// loadRuleFile parses and validates a Prometheus rule file
+func loadRuleFile(file string) ([]*ruleGroup, error) {
+	ruleGroups, errs := rulefmt.ParseFile(file, false)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("loading rule file %s: %w", file, errors.Join(errs...))
+	}
+
+	groups := make([]*ruleGroup, 0, len(ruleGroups.Groups))
+	for _, rg := range ruleGroups.Groups {
+		group := &ruleGroup{
+			name:  rg.Name,
+			file:  file,
+			limit: rg.Limit,
+		}
+		if rg.QueryOffset != nil {
+			group.queryOffset = time.Duration(*rg.QueryOffset)
+		}
+
+		for _, r := range rg.Rules {
+			name := r.Record
+			if r.Alert != "" {
+				name = r.Alert
+			}
+			expr, err := parser.ParseExpr(r.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: group %q, rule %q: %w", file, rg.Name, name, err)
+			}
+
+			lbls := ruleLabels(rg.Labels, r.Labels)
+			if r.Alert != "" {
+				// There is no earlier state to restore, so the rule starts out restored
+				// and writes its ALERTS series from the first evaluation
+				group.rules = append(group.rules, rules.NewAlertingRule(
+					r.Alert, expr, time.Duration(r.For), time.Duration(r.KeepFiringFor),
+					lbls, labels.FromMap(r.Annotations), labels.EmptyLabels(), "", true, slog.Default(),
+				))
+				continue
+			}
+			group.rules = append(group.rules, rules.NewRecordingRule(r.Record, expr, lbls))
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// ruleLabels merges the labels of a group into the labels of one of its rules.
+// Labels set on the rule take precedence.
+func ruleLabels(groupLabels, labelSet map[string]string) labels.Labels {
+	merged := make(map[string]string, len(groupLabels)+len(labelSet))
+	for name, value := range groupLabels {
+		merged[name] = value
+	}
+	for name, value := range labelSet {
+		merged[name] = value
+	}
+	return labels.FromMap(merged)
+}
+
+// EvaluateRules evaluates every rule of groups at ts and adds the resulting
+// samples to the store: the series of recording rules and the ALERTS series
+// of alerting rules. Alerting rules keep their pending and firing state
+// between evaluations. Evaluation continues past failing rules, whose errors
+// are returned together.
+func (s *MetricStore) EvaluateRules(ctx context.Context, groups []*ruleGroup, ts time.Time) error {
+	query := rules.EngineQueryFunc(s.engine, s.storage)
+	externalURL := &url.URL{}
+
+	var errs []error
+	for _, group := range groups {
+		for _, rule := range group.rules {
+			start := time.Now()
+			vector, err := rule.Eval(ctx, group.queryOffset, ts, query, externalURL, group.limit)
+			rule.SetEvaluationDuration(time.Since(start))
+			rule.SetEvaluationTimestamp(start)
+			rule.SetLastError(err)
+			if err != nil {
+				rule.SetHealth(rules.HealthBad)
+				errs = append(errs, fmt.Errorf("group %q, rule %q: %w", group.name, rule.Name(), err))
+				continue
+			}
+			rule.SetHealth(rules.HealthGood)
+			s.AddSamples(vector)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// writeRuleFile writes a rule file holding data and loads its groups
+func writeRuleFile(t *testing.T, data string) []*ruleGroup {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := loadRules(path)
+	if err != nil {
+		t.Fatalf("loading rules: %v", err)
+	}
+	return groups
+}
+
+func TestEvaluateRules(t *testing.T) {
+	groups := writeRuleFile(t, `groups:
+- name: chained
+  labels:
+    team: infra
+  rules:
+  - record: job:test_metric:sum
+    expr: sum by (job) (test_metric)
+    labels:
+      team: platform
+  - record: job:test_metric:doubled
+    expr: job:test_metric:sum * 2
+- name: limited
+  limit: 1
+  rules:
+  - record: test_metric:copies
+    expr: test_metric or label_replace(test_metric, "copy", "1", "", "")
+- name: offset
+  query_offset: 5m
+  rules:
+  - record: test_metric:offset
+    expr: test_metric
+`)
+	store := newEngineTestStore(t, DefaultEngineOptions())
+	ts := testTime(10 * time.Minute)
+
+	// The failing rule is reported without stopping the groups after it
+	err := store.EvaluateRules(context.Background(), groups, ts)
+	if err == nil || !strings.Contains(err.Error(), `group "limited", rule "test_metric:copies"`) || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("EvaluateRules = %v, want the limit error of test_metric:copies", err)
+	}
+
+	tests := []struct {
+		query string
+		want  map[string]float64
+	}{
+		// Rule labels take precedence over group labels
+		{"job:test_metric:sum", map[string]float64{`{__name__="job:test_metric:sum", job="test", team="platform"}`: 40}},
+		// Later rules use the series recorded by earlier ones
+		{"job:test_metric:doubled", map[string]float64{`{__name__="job:test_metric:doubled", job="test", team="infra"}`: 80}},
+		{"test_metric:copies", map[string]float64{}},
+		// A query offset evaluates, and stamps, the samples of a group earlier
+		{"test_metric:offset @ 300", map[string]float64{`{__name__="test_metric:offset", job="test"}`: 20}},
+	}
+	for _, tt := range tests {
+		result, err := store.ExecutePromQLAt(context.Background(), tt.query, ts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		got := make(map[string]float64)
+		for _, r := range result.Results {
+			got[labels.FromMap(r.Labels).String()] = r.Value
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for lbls, value := range tt.want {
+			if got[lbls] != value {
+				t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestLoadRulesErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("groups:\n- name: bad\n  rules:\n  - record: x\n    expr: sum(\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pattern string
+		wantErr string
+	}{
+		{filepath.Join(dir, "missing-*.yaml"), "no rule files match"},
+		{filepath.Join(dir, "[.yaml"), "invalid rule file pattern"},
+		{invalid, "loading rule file"},
+	}
+	for _, tt := range tests {
+		if _, err := loadRules(tt.pattern); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("loadRules(%s) = %v, want an error containing %q", tt.pattern, err, tt.wantErr)
+		}
+	}
+	if groups, err := loadRules(""); groups != nil || err != nil {
+		t.Errorf("loadRules without a pattern = %v, %v, want nothing", groups, err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+const (
+	// samplesPerChunk matches the chunk size Prometheus uses for float samples
+	samplesPerChunk = 120
+
+	// maxSamplesPerSeries is the number of samples kept per series to limit memory usage
+	maxSamplesPerSeries = 1000
+)
+
+// newTimeSeries creates an empty series that iterates over all of its samples
+func newTimeSeries(lbls labels.Labels) *TimeSeries {
+	return &TimeSeries{
+		SeriesLabels: lbls,
+		mint:         math.MinInt64,
+		maxt:         math.MaxInt64,
+	}
+}
+
+// TimeSeries represents a single time series with its samples stored
+// in Gorilla/XOR encoded chunks
+type TimeSeries struct {
+	SeriesLabels labels.Labels
+
+	chunks   []*seriesChunk
+	appender chunkenc.Appender
+
+	// mint and maxt bound the samples returned by Iterator for query views
+	mint, maxt int64
+}
+
+// seriesChunk is a single XOR chunk together with its time bounds
+type seriesChunk struct {
+	chunk   *chunkenc.XORChunk
+	minTime int64
+	maxTime int64
+}
+
+// InMemorySeriesIterator implements chunkenc.Iterator interface
+type InMemorySeriesIterator struct {
+	chunks     []*seriesChunk
+	mint, maxt int64
+
+	idx   int               // index of the chunk being read
+	cur   chunkenc.Iterator // iterator over chunks[idx], reused across chunks
+	valid bool              // whether cur is positioned on a sample in range
+}
+
+// append adds a sample to the head chunk, cutting a new chunk when it is full.
+// Samples that are not newer than the last one are dropped, as they cannot be
+// appended to an XOR chunk.
+func (ts *TimeSeries) append(t int64, v float64) bool {
+	head := ts.head()
+	if head != nil && t <= head.maxTime {
+		return false
+	}
+
+	if head == nil || head.chunk.NumSamples() >= samplesPerChunk {
+		if head != nil {
+			head.chunk.Compact()
+		}
+		head = &seriesChunk{chunk: chunkenc.NewXORChunk(), minTime: t}
+		app, err := head.chunk.Appender()
+		if err != nil {
+			return false
+		}
+		ts.chunks = append(ts.chunks, head)
+		ts.appender = app
+	}
+
+	ts.appender.Append(t, v)
+	head.maxTime = t
+
+	// Drop whole chunks from the front once enough newer samples are retained.
+	// The dropped slots are left as is, since query views may still share them.
+	for len(ts.chunks) > 1 && ts.numSamples()-ts.chunks[0].chunk.NumSamples() >= maxSamplesPerSeries {
+		ts.chunks = ts.chunks[1:]
+	}
+	return true
+}
+
+// head returns the chunk currently being appended to
+func (ts *TimeSeries) head() *seriesChunk {
+	if len(ts.chunks) == 0 {
+		return nil
+	}
+	return ts.chunks[len(ts.chunks)-1]
+}
+
+// numSamples returns the number of samples held by the series
+func (ts *TimeSeries) numSamples() int {
+	n := 0
+	for _, c := range ts.chunks {
+		n += c.chunk.NumSamples()
+	}
+	return n
+}
+
+// memoryBytes estimates the memory held by the series: its label strings and
+// the encoded bytes of its chunks
+func (ts *TimeSeries) memoryBytes() int {
+	n := 0
+	ts.SeriesLabels.Range(func(l labels.Label) {
+		n += len(l.Name) + len(l.Value)
+	})
+	for _, c := range ts.chunks {
+		n += len(c.chunk.Bytes())
+	}
+	return n
+}
+
+// view returns a read-only series limited to [mint, maxt], or nil when no
+// sample falls in that range. Full chunks are shared with the store; the head
+// chunk is copied since it may still be appended to while the query runs.
+func (ts *TimeSeries) view(mint, maxt int64) *TimeSeries {
+	lo := sort.Search(len(ts.chunks), func(i int) bool {
+		return ts.chunks[i].maxTime >= mint
+	})
+	hi := lo + sort.Search(len(ts.chunks)-lo, func(i int) bool {
+		return ts.chunks[lo+i].minTime > maxt
+	})
+	if lo == hi {
+		return nil
+	}
+
+	chunks := ts.chunks[lo:hi:hi]
+	if hi == len(ts.chunks) {
+		head := chunks[len(chunks)-1]
+		snapshot := chunkenc.NewXORChunk()
+		snapshot.Reset(bytes.Clone(head.chunk.Bytes()))
+
+		chunks = append(chunks[:len(chunks)-1:len(chunks)-1], &seriesChunk{
+			chunk:   snapshot,
+			minTime: head.minTime,
+			maxTime: head.maxTime,
+		})
+	}
+
+	return &TimeSeries{
+		SeriesLabels: ts.SeriesLabels,
+		chunks:       chunks,
+		mint:         mint,
+		maxt:         maxt,
+	}
+}
+
+// TimeSeries implements storage.Series interface
+func (ts *TimeSeries) Labels() labels.Labels {
+	return ts.SeriesLabels
+}
+
+func (ts *TimeSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	// Reuse the caller's iterator when it is one of ours
+	if iter, ok := it.(*InMemorySeriesIterator); ok {
+		iter.reset(ts.chunks, ts.mint, ts.maxt)
+		return iter
+	}
+	iter := &InMemorySeriesIterator{}
+	iter.reset(ts.chunks, ts.mint, ts.maxt)
+	return iter
+}
+
+// reset points the iterator at a new set of chunks
+func (it *InMemorySeriesIterator) reset(chunks []*seriesChunk, mint, maxt int64) {
+	it.chunks = chunks
+	it.mint = mint
+	it.maxt = maxt
+	it.idx = 0
+	it.valid = false
+	if len(chunks) > 0 {
+		it.cur = chunks[0].chunk.Iterator(it.cur)
+	}
+}
+
+// SeriesIterator interface implementation
+func (it *InMemorySeriesIterator) Next() chunkenc.ValueType {
+	for it.idx < len(it.chunks) {
+		if it.cur.Next() == chunkenc.ValNone {
+			it.nextChunk()
+			continue
+		}
+		t := it.cur.AtT()
+		if t < it.mint {
+			continue
+		}
+		if t > it.maxt {
+			break
+		}
+		it.valid = true
+		return chunkenc.ValFloat
+	}
+	it.idx = len(it.chunks)
+	it.valid = false
+	return chunkenc.ValNone
+}
+
+// Seek advances to the first sample at or after t. It never moves backwards:
+// if the current sample already satisfies t, the iterator stays where it is.
+// Chunks that end before t are skipped by binary search on their time bounds.
+func (it *InMemorySeriesIterator) Seek(t int64) chunkenc.ValueType {
+	if it.valid && it.cur.AtT() >= t {
+		return chunkenc.ValFloat
+	}
+	if it.idx >= len(it.chunks) {
+		return chunkenc.ValNone
+	}
+	if t < it.mint {
+		t = it.mint
+	}
+
+	remaining := it.chunks[it.idx:]
+	skip := sort.Search(len(remaining), func(i int) bool {
+		return remaining[i].maxTime >= t
+	})
+	if skip > 0 {
+		it.idx += skip
+		if it.idx >= len(it.chunks) {
+			it.valid = false
+			return chunkenc.ValNone
+		}
+		it.cur = it.chunks[it.idx].chunk.Iterator(it.cur)
+	}
+
+	if it.cur.Seek(t) == chunkenc.ValNone {
+		// The chunk ran out before t, carry on with the next one
+		it.nextChunk()
+		return it.Next()
+	}
+	if it.cur.AtT() > it.maxt {
+		it.idx = len(it.chunks)
+		it.valid = false
+		return chunkenc.ValNone
+	}
+	it.valid = true
+	return chunkenc.ValFloat
+}
+
+// nextChunk moves the iterator to the start of the following chunk
+func (it *InMemorySeriesIterator) nextChunk() {
+	it.idx++
+	it.valid = false
+	if it.idx < len(it.chunks) {
+		it.cur = it.chunks[it.idx].chunk.Iterator(it.cur)
+	}
+}
+
+func (it *InMemorySeriesIterator) At() (int64, float64) {
+	if !it.valid {
+		return 0, 0
+	}
+	return it.cur.At()
+}
+
+func (it *InMemorySeriesIterator) AtHistogram(h *histogram.Histogram) (int64, *histogram.Histogram) {
+	return 0, nil
+}
+
+func (it *InMemorySeriesIterator) AtFloatHistogram(fh *histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
+	return 0, nil
+}
+
+func (it *InMemorySeriesIterator) AtT() int64 {
+	if !it.valid {
+		return 0
+	}
+	return it.cur.AtT()
+}
+
+func (it *InMemorySeriesIterator) Err() error {
+	if it.cur != nil && it.idx < len(it.chunks) {
+		return it.cur.Err()
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// newTestSeries returns a series holding n samples one second apart from
+// t=0, with the value of each sample its index
+func newTestSeries(n int) *TimeSeries {
+	series := newTimeSeries(labels.FromStrings(labels.MetricName, "test_metric"))
+	for i := range n {
+		series.append(int64(i)*1000, float64(i))
+	}
+	return series
+}
+
+// iterTimes returns the timestamps of the samples left in it
+func iterTimes(it chunkenc.Iterator) []int64 {
+	var times []int64
+	for it.Next() == chunkenc.ValFloat {
+		t, _ := it.At()
+		times = append(times, t)
+	}
+	return times
+}
+
+func TestSeriesIteratorNext(t *testing.T) {
+	// Three chunks: two full ones and a head chunk of 60 samples
+	series := newTestSeries(2*samplesPerChunk + 60)
+	if len(series.chunks) != 3 {
+		t.Fatalf("series has %d chunks, want 3", len(series.chunks))
+	}
+
+	times := iterTimes(series.Iterator(nil))
+	if len(times) != 2*samplesPerChunk+60 {
+		t.Fatalf("iterated %d samples, want %d", len(times), 2*samplesPerChunk+60)
+	}
+	for i, ts := range times {
+		if ts != int64(i)*1000 {
+			t.Fatalf("sample %d at %d, want %d", i, ts, int64(i)*1000)
+		}
+	}
+}
+
+func TestSeriesIteratorSeek(t *testing.T) {
+	series := newTestSeries(2*samplesPerChunk + 60)
+	last := int64(2*samplesPerChunk+59) * 1000
+
+	tests := []struct {
+		name   string
+		seek   int64
+		wantT  int64
+		wantOK bool
+	}{
+		{"before first sample", -5000, 0, true},
+		{"first sample", 0, 0, true},
+		{"last sample of first chunk", 119000, 119000, true},
+		{"between chunks", 119500, 120000, true},
+		{"first sample of second chunk", 120000, 120000, true},
+		{"first sample of head chunk", 240000, 240000, true},
+		{"last sample", last, last, true},
+		{"after last sample", last + 1, 0, false},
+	}
+	for _, tt := range tests {
+		it := series.Iterator(nil)
+		got := it.Seek(tt.seek)
+		if (got == chunkenc.ValFloat) != tt.wantOK {
+			t.Errorf("%s: Seek(%d) = %v, want found %v", tt.name, tt.seek, got, tt.wantOK)
+			continue
+		}
+		if !tt.wantOK {
+			continue
+		}
+		ts, v := it.At()
+		if ts != tt.wantT || v != float64(tt.wantT/1000) {
+			t.Errorf("%s: Seek(%d) at (%d, %g), want (%d, %g)", tt.name, tt.seek, ts, v, tt.wantT, float64(tt.wantT/1000))
+		}
+		// Next carries on from the sought sample across the chunk boundary
+		if tt.wantT < last {
+			if it.Next() != chunkenc.ValFloat || it.AtT() != tt.wantT+1000 {
+				t.Errorf("%s: Next after Seek(%d) at %d, want %d", tt.name, tt.seek, it.AtT(), tt.wantT+1000)
+			}
+		}
+	}
+}
+
+func TestSeriesIteratorSeekBackwards(t *testing.T) {
+	series := newTestSeries(2*samplesPerChunk + 60)
+	it := series.Iterator(nil)
+
+	if it.Seek(200000) != chunkenc.ValFloat || it.AtT() != 200000 {
+		t.Fatalf("Seek(200000) at %d, want 200000", it.AtT())
+	}
+	if it.Seek(10000) != chunkenc.ValFloat || it.AtT() != 200000 {
+		t.Errorf("Seek(10000) moved to %d, want it to stay at 200000", it.AtT())
+	}
+	if it.Next() != chunkenc.ValFloat || it.AtT() != 201000 {
+		t.Errorf("Next after a backwards Seek at %d, want 201000", it.AtT())
+	}
+}
+
+func TestSeriesViewIterator(t *testing.T) {
+	series := newTestSeries(2*samplesPerChunk + 60)
+
+	tests := []struct {
+		name       string
+		mint, maxt int64
+		wantFirst  int64
+		wantLast   int64
+		wantChunks int
+	}{
+		{"whole series", 0, 299000, 0, 299000, 3},
+		{"inside one chunk", 10500, 20000, 11000, 20000, 1},
+		{"across a boundary", 100000, 130000, 100000, 130000, 2},
+		{"head chunk only", 250000, 400000, 250000, 299000, 1},
+	}
+	for _, tt := range tests {
+		view := series.view(tt.mint, tt.maxt)
+		if view == nil {
+			t.Errorf("%s: view(%d, %d) is empty", tt.name, tt.mint, tt.maxt)
+			continue
+		}
+		if len(view.chunks) != tt.wantChunks {
+			t.Errorf("%s: view holds %d chunks, want %d", tt.name, len(view.chunks), tt.wantChunks)
+		}
+		times := iterTimes(view.Iterator(nil))
+		if len(times) == 0 || times[0] != tt.wantFirst || times[len(times)-1] != tt.wantLast {
+			t.Errorf("%s: view iterates %d samples from %v, want %d to %d", tt.name, len(times), times[:min(len(times), 1)], tt.wantFirst, tt.wantLast)
+		}
+
+		it := view.Iterator(nil)
+		if it.Seek(tt.mint-1000) != chunkenc.ValFloat || it.AtT() != tt.wantFirst {
+			t.Errorf("%s: Seek before the view at %d, want %d", tt.name, it.AtT(), tt.wantFirst)
+		}
+		if it.Seek(tt.wantLast+1) != chunkenc.ValNone {
+			t.Errorf("%s: Seek past the view found a sample at %d", tt.name, it.AtT())
+		}
+	}
+
+	if view := series.view(400000, 500000); view != nil {
+		t.Errorf("view after the last sample holds %d chunks, want none", len(view.chunks))
+	}
+}
+
+func TestSeriesIteratorReuse(t *testing.T) {
+	first := newTestSeries(samplesPerChunk + 10)
+	second := newTestSeries(20)
+
+	it := first.Iterator(nil)
+	it.Seek(50000)
+	reused := second.Iterator(it)
+	if reused != it {
+		t.Errorf("Iterator did not reuse the given iterator")
+	}
+	if times := iterTimes(reused); len(times) != 20 || times[0] != 0 {
+		t.Errorf("reused iterator returned %d samples from %v, want 20 from 0", len(times), times[:min(len(times), 1)])
+	}
+}
+
+// benchmarkStore returns a store holding numSeries series of
+// maxSamplesPerSeries samples 15 seconds apart, and the time of their last
+// sample
+func benchmarkStore(b *testing.B, numSeries int) (*MetricStore, time.Time) {
+	b.Helper()
+
+	store := newTestStore(b)
+	for s := range numSeries {
+		lbls := labels.FromStrings(labels.MetricName, "bench_requests_total", "instance", fmt.Sprintf("node-%d", s))
+		for i := range maxSamplesPerSeries {
+			store.appendSample(lbls, int64(i)*15000, float64(i*s))
+		}
+	}
+	return store, time.UnixMilli(int64(maxSamplesPerSeries-1) * 15000)
+}
+
+func BenchmarkSeriesIteratorSeek(b *testing.B) {
+	series := newTestSeries(maxSamplesPerSeries)
+	it := series.Iterator(nil)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		it = series.Iterator(it)
+		// Seek every step of a range query, as the engine does
+		for ts := int64(0); ts < int64(maxSamplesPerSeries)*1000; ts += 15000 {
+			it.Seek(ts)
+		}
+	}
+}
+
+func BenchmarkSelect(b *testing.B) {
+	store, end := benchmarkStore(b, 1000)
+	matcher := labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "bench_requests_total")
+	querier, err := store.storage.Querier(end.Add(-time.Hour).UnixMilli(), end.UnixMilli())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		set := querier.Select(context.Background(), false, nil, matcher)
+		for set.Next() {
+		}
+	}
+}
+
+func BenchmarkRangeQuery(b *testing.B) {
+	for _, numSeries := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("series=%d", numSeries), func(b *testing.B) {
+			store, end := benchmarkStore(b, numSeries)
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			for b.Loop() {
+				q, err := store.engine.NewRangeQuery(ctx, store.storage, nil,
+					"sum(rate(bench_requests_total[5m]))", end.Add(-3*time.Hour), end, 15*time.Second)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if result := q.Exec(ctx); result.Err != nil {
+					b.Fatal(result.Err)
+				}
+				q.Close()
+			}
+		})
+	}
+}
+
+func TestSeriesAppendCutsChunks(t *testing.T) {
+	tests := []struct {
+		samples     int
+		wantChunks  int
+		wantHeadLen int
+	}{
+		{1, 1, 1},
+		{samplesPerChunk, 1, samplesPerChunk},
+		{samplesPerChunk + 1, 2, 1},
+		{2 * samplesPerChunk, 2, samplesPerChunk},
+		{2*samplesPerChunk + 1, 3, 1},
+	}
+	for _, tt := range tests {
+		series := newTestSeries(tt.samples)
+		if len(series.chunks) != tt.wantChunks {
+			t.Errorf("%d samples: %d chunks, want %d", tt.samples, len(series.chunks), tt.wantChunks)
+			continue
+		}
+		if n := series.head().chunk.NumSamples(); n != tt.wantHeadLen {
+			t.Errorf("%d samples: head chunk holds %d, want %d", tt.samples, n, tt.wantHeadLen)
+		}
+		for i, c := range series.chunks {
+			wantMin := int64(i*samplesPerChunk) * 1000
+			wantMax := int64(min((i+1)*samplesPerChunk, tt.samples)-1) * 1000
+			if c.minTime != wantMin || c.maxTime != wantMax {
+				t.Errorf("%d samples: chunk %d spans [%d, %d], want [%d, %d]", tt.samples, i, c.minTime, c.maxTime, wantMin, wantMax)
+			}
+		}
+	}
+}
+
+func TestSeriesAppendOutOfOrder(t *testing.T) {
+	series := newTestSeries(10)
+	if series.append(9000, 1) {
+		t.Errorf("appending a sample at the time of the last one succeeded")
+	}
+	if series.append(5000, 1) {
+		t.Errorf("appending an older sample succeeded")
+	}
+	if n := series.numSamples(); n != 10 {
+		t.Errorf("series holds %d samples, want 10", n)
+	}
+}
+
+func TestSeriesAppendRetention(t *testing.T) {
+	tests := []struct {
+		name        string
+		samples     int
+		wantSamples int
+		wantFirst   int64
+	}{
+		{"under the limit", maxSamplesPerSeries - 1, maxSamplesPerSeries - 1, 0},
+		{"at the limit", maxSamplesPerSeries, maxSamplesPerSeries, 0},
+		// The oldest chunk is only dropped once the newer chunks hold the limit
+		{"first chunk still needed", maxSamplesPerSeries + samplesPerChunk - 1, maxSamplesPerSeries + samplesPerChunk - 1, 0},
+		{"first chunk dropped", maxSamplesPerSeries + samplesPerChunk, maxSamplesPerSeries, samplesPerChunk * 1000},
+		// Whole chunks are kept, so up to a chunk more than the limit remains:
+		// 25 full chunks leave the last 9, since 8 hold fewer than the limit
+		{"several chunks dropped", 25 * samplesPerChunk, 9 * samplesPerChunk, 16 * samplesPerChunk * 1000},
+	}
+	for _, tt := range tests {
+		series := newTestSeries(tt.samples)
+		if n := series.numSamples(); n != tt.wantSamples {
+			t.Errorf("%s: series holds %d samples, want %d", tt.name, n, tt.wantSamples)
+		}
+		it := series.Iterator(nil)
+		if it.Next() != chunkenc.ValFloat || it.AtT() != tt.wantFirst {
+			t.Errorf("%s: first sample at %d, want %d", tt.name, it.AtT(), tt.wantFirst)
+		}
+	}
+}
+
+func TestSeriesViewSnapshot(t *testing.T) {
+	series := newTestSeries(samplesPerChunk + 10)
+	view := series.view(0, 1<<40)
+
+	// Full chunks are shared, the head chunk is a copy
+	if view.chunks[0] != series.chunks[0] {
+		t.Errorf("view copied a full chunk")
+	}
+	if view.chunks[1] == series.chunks[1] || view.chunks[1].chunk == series.chunks[1].chunk {
+		t.Errorf("view shares the head chunk")
+	}
+
+	// Samples appended after the view was taken, up to the retention limit,
+	// are not seen by it
+	for i := samplesPerChunk + 10; i < maxSamplesPerSeries+2*samplesPerChunk; i++ {
+		series.append(int64(i)*1000, float64(i))
+	}
+	times := iterTimes(view.Iterator(nil))
+	if len(times) != samplesPerChunk+10 || times[0] != 0 || times[len(times)-1] != int64(samplesPerChunk+9)*1000 {
+		t.Errorf("view iterates %d samples after appends, want %d from 0", len(times), samplesPerChunk+10)
+	}
+	if first := iterTimes(series.Iterator(nil))[0]; first == 0 {
+		t.Errorf("series kept its first chunk past retention")
+	}
+}
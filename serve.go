@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// shutdownTimeout bounds how long in-flight requests may take once the server stops
+const shutdownTimeout = 5 * time.Second
+
+// Prometheus HTTP API error types
+const (
+	errorBadData   = "bad_data"
+	errorExecution = "execution"
+)
+
+// apiResponse is the envelope of every Prometheus HTTP API response
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+	Infos     []string    `json:"infos,omitempty"`
+}
+
+// queryData is the data of an /api/v1/query response
+type queryData struct {
+	ResultType parser.ValueType `json:"resultType"`
+	Result     parser.Value     `json:"result"`
+}
+
+// targetData is a target in an /api/v1/targets response. lastScrapeSamples,
+// retries and errorKind are not part of the Prometheus API.
+type targetData struct {
+	DiscoveredLabels   map[string]string `json:"discoveredLabels"`
+	Labels             map[string]string `json:"labels"`
+	ScrapePool         string            `json:"scrapePool"`
+	ScrapeURL          string            `json:"scrapeUrl"`
+	GlobalURL          string            `json:"globalUrl"`
+	LastError          string            `json:"lastError"`
+	LastScrape         time.Time         `json:"lastScrape"`
+	LastScrapeDuration float64           `json:"lastScrapeDuration"`
+	Health             string            `json:"health"`
+	ScrapeInterval     string            `json:"scrapeInterval"`
+	ScrapeTimeout      string            `json:"scrapeTimeout"`
+	LastScrapeSamples  int               `json:"lastScrapeSamples"`
+	Retries            int               `json:"retries"`
+	ErrorKind          string            `json:"errorKind,omitempty"`
+}
+
+// targetsData is the data of an /api/v1/targets response. Every target is
+// active since kubeprom drops none.
+type targetsData struct {
+	ActiveTargets  []targetData `json:"activeTargets"`
+	DroppedTargets []targetData `json:"droppedTargets"`
+}
+
+// server exposes a metric store through a subset of the Prometheus HTTP API
+type server struct {
+	*storeCollector
+
+	// interval is the time between collections, reported as the scrape
+	// interval of every target
+	interval time.Duration
+}
+
+// runServe collects metrics periodically and serves the Prometheus HTTP API
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var cluster clusterFlags
+	var listen string
+	var interval time.Duration
+	var rulesPattern string
+	var amURLs alertmanagerURLs
+	var amService string
+	var resendDelay time.Duration
+	engineOpts := DefaultEngineOptions()
+
+	cluster.register(fs)
+	fs.StringVar(&rulesPattern, "rules", "",
+		"Prometheus rule file, or glob of rule files, whose recording and alerting rules are evaluated after each collection")
+	fs.StringVar(&listen, "listen", ":9090",
+		"Address to serve the HTTP API on")
+	fs.DurationVar(&interval, "interval", 30*time.Second,
+		"Interval between metric collections")
+	fs.Var(&amURLs, "alertmanager-url",
+		"Alertmanager URL that firing alerts are sent to (repeatable)")
+	fs.StringVar(&amService, "alertmanager-service", "",
+		"Discover Alertmanagers from the endpoints of a Service in every context, as namespace/name[:port]")
+	fs.DurationVar(&resendDelay, "alert-resend-delay", defaultResendDelay,
+		"Minimum time to wait before re-sending an alert that is still firing")
+	addEngineFlags(fs, &engineOpts)
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Collect metrics every -interval and serve them through the Prometheus\n")
+		fmt.Fprintf(fs.Output(), "HTTP API endpoints /api/v1/query, /api/v1/metadata, /api/v1/targets and\n")
+		fmt.Fprintf(fs.Output(), "/api/v1/status/tsdb, with liveness and readiness probes on /-/healthy and\n")
+		fmt.Fprintf(fs.Output(), "/-/ready.\n\n")
+		fmt.Fprintf(fs.Output(), "Examples:\n")
+		fmt.Fprintf(fs.Output(), "  %s serve\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s serve -listen localhost:9091 -interval 1m\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s serve -rules alerts.yaml -alertmanager-url http://localhost:9093\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	cluster.parse(fs, args)
+
+	if interval <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -interval must be positive\n\n")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := applyEngineFlags(engineOpts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ruleGroups, err := loadRules(rulesPattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	clients, err := cluster.clients()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	store, err := NewMetricStore(engineOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to create metric store: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	srv := &server{
+		storeCollector: &storeCollector{
+			store:      store,
+			clients:    clients,
+			cluster:    cluster,
+			ruleGroups: ruleGroups,
+		},
+		interval: interval,
+	}
+
+	if len(amURLs) > 0 || amService != "" {
+		srv.notifier, err = newAlertNotifier(clients, amURLs, amService, resendDelay, interval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Serve while the first collection runs, so liveness probes pass and
+	// readiness probes fail until the store holds metrics
+	fmt.Fprintln(os.Stderr, "Collecting metrics from Kubernetes components...")
+	go func() {
+		srv.collect()
+		srv.collectEvery(ctx, interval)
+	}()
+
+	httpServer := &http.Server{
+		Addr:    listen,
+		Handler: srv.handler(),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving Prometheus HTTP API on %s\n", listen)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// handler routes the supported Prometheus HTTP API endpoints
+func (srv *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query", srv.handleQuery)
+	mux.HandleFunc("/api/v1/metadata", srv.handleMetadata)
+	mux.HandleFunc("/api/v1/targets", srv.handleTargets)
+	mux.HandleFunc("/api/v1/status/tsdb", srv.handleTSDBStatus)
+	mux.HandleFunc("/-/healthy", srv.handleHealthy)
+	mux.HandleFunc("/-/ready", srv.handleReady)
+	return mux
+}
+
+// handleHealthy is the liveness endpoint; it succeeds while the server runs
+func (srv *server) handleHealthy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "kubeprom is Healthy.")
+}
+
+// handleReady is the readiness endpoint; it succeeds once the first
+// collection has completed, so queries are not routed to an empty store
+func (srv *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !srv.collected.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "Service Unavailable")
+		return
+	}
+	fmt.Fprintln(w, "kubeprom is Ready.")
+}
+
+// handleQuery evaluates an instant query
+func (srv *server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	if _, err := parser.ParseExpr(query); err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"query\": %w", err))
+		return
+	}
+
+	ts, err := parseEvalTime(r.FormValue("time"), time.Now())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"time\": %w", err))
+		return
+	}
+
+	q, result, err := srv.store.instantQuery(r.Context(), query, ts, nil)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, errorExecution, err)
+		return
+	}
+	defer q.Close()
+
+	warnings, infos := result.Warnings.AsStrings(query, 0, 0)
+	writeAPIResponse(w, http.StatusOK, apiResponse{
+		Status: "success",
+		Data: queryData{
+			ResultType: result.Value.Type(),
+			Result:     result.Value,
+		},
+		Warnings: warnings,
+		Infos:    infos,
+	})
+}
+
+// handleMetadata returns the metadata of all metrics, or of the metric named
+// by the metric parameter, limited to limit metrics when it is set
+func (srv *server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	limit := -1
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"limit\": %w", err))
+			return
+		}
+	}
+
+	metadata := srv.store.Metadata()
+	if metric := r.FormValue("metric"); metric != "" {
+		filtered := make(map[string][]MetricMetadata)
+		if entries, ok := metadata[metric]; ok {
+			filtered[metric] = entries
+		}
+		metadata = filtered
+	}
+
+	if limit >= 0 && len(metadata) > limit {
+		limited := make(map[string][]MetricMetadata, limit)
+		for _, metric := range sortedKeys(metadata)[:limit] {
+			limited[metric] = metadata[metric]
+		}
+		metadata = limited
+	}
+
+	writeAPIResponse(w, http.StatusOK, apiResponse{
+		Status: "success",
+		Data:   metadata,
+	})
+}
+
+// handleTargets returns the scrape status of every target, optionally only of
+// those of the scrapePool parameter. Targets are in the scrape pool of their
+// component, such as kubelet.
+func (srv *server) handleTargets(w http.ResponseWriter, r *http.Request) {
+	state := r.FormValue("state")
+	switch state {
+	case "", "any", "active", "dropped":
+	default:
+		writeAPIError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"state\": %q", state))
+		return
+	}
+	scrapePool := r.FormValue("scrapePool")
+
+	data := targetsData{ActiveTargets: []targetData{}, DroppedTargets: []targetData{}}
+	if state != "dropped" {
+		for _, target := range srv.store.Targets() {
+			pool := target.Labels["job"]
+			if scrapePool != "" && pool != scrapePool {
+				continue
+			}
+			data.ActiveTargets = append(data.ActiveTargets, targetData{
+				DiscoveredLabels:   target.DiscoveredLabels,
+				Labels:             target.Labels,
+				ScrapePool:         pool,
+				ScrapeURL:          target.ScrapeURL,
+				GlobalURL:          target.ScrapeURL,
+				LastError:          target.LastError,
+				LastScrape:         target.LastScrape,
+				LastScrapeDuration: target.Duration.Seconds(),
+				Health:             target.Health,
+				ScrapeInterval:     model.Duration(srv.interval).String(),
+				ScrapeTimeout:      model.Duration(collectionTimeout).String(),
+				LastScrapeSamples:  target.Samples,
+				Retries:            target.Retries,
+				ErrorKind:          target.ErrorKind,
+			})
+		}
+	}
+
+	writeAPIResponse(w, http.StatusOK, apiResponse{
+		Status: "success",
+		Data:   data,
+	})
+}
+
+// handleTSDBStatus returns the cardinality report of the store, with limit
+// entries in each list
+func (srv *server) handleTSDBStatus(w http.ResponseWriter, r *http.Request) {
+	limit := defaultCardinalityLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			writeAPIError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("limit must be a positive number"))
+			return
+		}
+	}
+
+	writeAPIResponse(w, http.StatusOK, apiResponse{
+		Status: "success",
+		Data:   srv.store.Cardinality(limit),
+	})
+}
+
+// writeAPIError writes a Prometheus HTTP API error response
+func writeAPIError(w http.ResponseWriter, code int, errorType string, err error) {
+	writeAPIResponse(w, code, apiResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
+// writeAPIResponse writes resp as JSON with the given status code
+func writeAPIResponse(w http.ResponseWriter, code int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeProbes(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	srv := &server{
+		storeCollector: &storeCollector{
+			store:   newTestStore(t),
+			clients: []*clusterClient{cluster.client()},
+		},
+	}
+	api := httptest.NewServer(srv.handler())
+	t.Cleanup(api.Close)
+
+	probe := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(api.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Before the first collection the server is alive but not ready
+	if code := probe("/-/healthy"); code != http.StatusOK {
+		t.Errorf("/-/healthy before collection = %d, want %d", code, http.StatusOK)
+	}
+	if code := probe("/-/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("/-/ready before collection = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	srv.collect()
+
+	if code := probe("/-/healthy"); code != http.StatusOK {
+		t.Errorf("/-/healthy after collection = %d, want %d", code, http.StatusOK)
+	}
+	if code := probe("/-/ready"); code != http.StatusOK {
+		t.Errorf("/-/ready after collection = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestServeTargets(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	cluster.serveError(nodeProxyPath("node-a", "metrics"), http.StatusForbidden)
+	api := newTestAPI(t, cluster)
+
+	get := func(query string) (int, targetsData) {
+		t.Helper()
+		var data targetsData
+		code, _ := getAPI(t, api, "/api/v1/targets"+query, &data)
+		return code, data
+	}
+
+	code, data := get("")
+	if code != http.StatusOK || len(data.ActiveTargets) != 5 || len(data.DroppedTargets) != 0 {
+		t.Fatalf("targets = %d with %d active and %d dropped, want 200 with 5 active",
+			code, len(data.ActiveTargets), len(data.DroppedTargets))
+	}
+
+	_, data = get("?scrapePool=kubelet")
+	if len(data.ActiveTargets) != 1 {
+		t.Fatalf("kubelet pool has %d targets, want 1", len(data.ActiveTargets))
+	}
+	kubelet := data.ActiveTargets[0]
+	if kubelet.Health != healthDown || kubelet.ErrorKind != errorKindForbidden || kubelet.LastError == "" {
+		t.Errorf("kubelet health %s, error %s: %q, want a forbidden failure", kubelet.Health, kubelet.ErrorKind, kubelet.LastError)
+	}
+	if want := cluster.server.URL + nodeProxyPath("node-a", "metrics"); kubelet.ScrapeURL != want {
+		t.Errorf("kubelet scrape URL = %q, want %q", kubelet.ScrapeURL, want)
+	}
+	if kubelet.ScrapeInterval != "1m" || kubelet.Labels["job"] != "kubelet" {
+		t.Errorf("kubelet interval %s, labels %v, want 1m and job kubelet", kubelet.ScrapeInterval, kubelet.Labels)
+	}
+
+	if _, data = get("?state=dropped"); len(data.ActiveTargets) != 0 {
+		t.Errorf("state=dropped returned %d active targets, want none", len(data.ActiveTargets))
+	}
+	if code, _ = get("?state=unknown"); code != http.StatusBadRequest {
+		t.Errorf("state=unknown = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+// apiResult is a decoded Prometheus HTTP API response with its data left raw
+type apiResult struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+	Warnings  []string        `json:"warnings"`
+}
+
+// newTestAPI serves the API of a server that has collected once from cluster
+func newTestAPI(t *testing.T, cluster *fakeCluster) *httptest.Server {
+	t.Helper()
+
+	srv := &server{
+		storeCollector: &storeCollector{
+			store:   newTestStore(t),
+			clients: []*clusterClient{cluster.client()},
+		},
+		interval: time.Minute,
+	}
+	srv.collect()
+	api := httptest.NewServer(srv.handler())
+	t.Cleanup(api.Close)
+	return api
+}
+
+// getAPI requests path from api and returns the status code and response,
+// decoding its data into data when it is not nil
+func getAPI(t *testing.T, api *httptest.Server, path string, data any) (int, apiResult) {
+	t.Helper()
+
+	resp, err := http.Get(api.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	var result apiResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decoding %s: %v", path, err)
+	}
+	if data != nil && result.Data != nil {
+		if err := json.Unmarshal(result.Data, data); err != nil {
+			t.Fatalf("decoding data of %s: %v", path, err)
+		}
+	}
+	return resp.StatusCode, result
+}
+
+func TestServeQuery(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	cluster.serveError(podProxyPath("kube-system", "kube-scheduler-node-a", 10259, "metrics"), http.StatusForbidden)
+	api := newTestAPI(t, cluster)
+
+	var data struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]any            `json:"value"`
+		} `json:"result"`
+	}
+	code, resp := getAPI(t, api, "/api/v1/query?query=kubelet_running_pods", &data)
+	if code != http.StatusOK || resp.Status != "success" {
+		t.Fatalf("query = %d %s: %s", code, resp.Status, resp.Error)
+	}
+	if data.ResultType != "vector" || len(data.Result) != 1 || data.Result[0].Value[1] != "12" {
+		t.Errorf("query returned %+v, want a vector with kubelet_running_pods 12", data)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "failed to collect metrics from scheduler") {
+		t.Errorf("query warnings = %q, want the failed scheduler scrape", resp.Warnings)
+	}
+
+	// A time long after the collection is outside the lookback delta
+	future := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	if _, resp = getAPI(t, api, "/api/v1/query?query=kubelet_running_pods&time="+future, &data); resp.Status != "success" || len(data.Result) != 0 {
+		t.Errorf("query an hour later = %s with %d results, want none", resp.Status, len(data.Result))
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		wantCode  int
+		wantError string
+	}{
+		{"invalid query", "/api/v1/query?query=" + url.QueryEscape("sum("), http.StatusBadRequest, errorBadData},
+		{"missing query", "/api/v1/query", http.StatusBadRequest, errorBadData},
+		{"invalid time", "/api/v1/query?query=up&time=yesterday", http.StatusBadRequest, errorBadData},
+		{"execution error", "/api/v1/query?query=" + url.QueryEscape(`label_replace(kubelet_running_pods, "a", "$1", "b", "(")`),
+			http.StatusUnprocessableEntity, errorExecution},
+	}
+	for _, tt := range tests {
+		code, resp := getAPI(t, api, tt.path, nil)
+		if code != tt.wantCode || resp.Status != "error" || resp.ErrorType != tt.wantError {
+			t.Errorf("%s: %d %s %s, want %d error %s", tt.name, code, resp.Status, resp.ErrorType, tt.wantCode, tt.wantError)
+		}
+	}
+}
+
+func TestServeMetadata(t *testing.T) {
+	api := newTestAPI(t, newStandardFakeCluster(t))
+
+	var all map[string][]MetricMetadata
+	if code, resp := getAPI(t, api, "/api/v1/metadata", &all); code != http.StatusOK || resp.Status != "success" {
+		t.Fatalf("metadata = %d %s: %s", code, resp.Status, resp.Error)
+	}
+	want := MetricMetadata{Type: "gauge", Help: "[ALPHA] Number of pods that have a running pod sandbox"}
+	if got := all["kubelet_running_pods"]; len(got) != 1 || got[0] != want {
+		t.Errorf("kubelet_running_pods metadata = %+v, want %+v", got, want)
+	}
+
+	tests := []struct {
+		path     string
+		wantKeys int
+	}{
+		{"/api/v1/metadata?metric=kubelet_running_pods", 1},
+		{"/api/v1/metadata?metric=missing_metric", 0},
+		{"/api/v1/metadata?limit=2", 2},
+		{"/api/v1/metadata?limit=0", 0},
+		{"/api/v1/metadata?limit=-1", len(all)},
+	}
+	for _, tt := range tests {
+		var metadata map[string][]MetricMetadata
+		if code, _ := getAPI(t, api, tt.path, &metadata); code != http.StatusOK || len(metadata) != tt.wantKeys {
+			t.Errorf("%s = %d with %d metrics, want 200 with %d", tt.path, code, len(metadata), tt.wantKeys)
+		}
+	}
+
+	if code, resp := getAPI(t, api, "/api/v1/metadata?limit=ten", nil); code != http.StatusBadRequest || resp.ErrorType != errorBadData {
+		t.Errorf("limit=ten = %d %s, want %d %s", code, resp.ErrorType, http.StatusBadRequest, errorBadData)
+	}
+}
+
+func TestServeTSDBStatus(t *testing.T) {
+	api := newTestAPI(t, newStandardFakeCluster(t))
+
+	var report CardinalityReport
+	if code, resp := getAPI(t, api, "/api/v1/status/tsdb?limit=3", &report); code != http.StatusOK || resp.Status != "success" {
+		t.Fatalf("tsdb status = %d %s: %s", code, resp.Status, resp.Error)
+	}
+	if report.HeadStats.NumSeries == 0 || len(report.SeriesCountByMetricName) != 3 {
+		t.Errorf("tsdb status has %d series and %d metric names, want some series and 3 names",
+			report.HeadStats.NumSeries, len(report.SeriesCountByMetricName))
+	}
+
+	for _, limit := range []string{"0", "-1", "ten"} {
+		if code, resp := getAPI(t, api, "/api/v1/status/tsdb?limit="+limit, nil); code != http.StatusBadRequest || resp.ErrorType != errorBadData {
+			t.Errorf("limit=%s = %d %s, want %d %s", limit, code, resp.ErrorType, http.StatusBadRequest, errorBadData)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// sessionVersion is the version of the session archive layout
+	sessionVersion = 1
+
+	// sessionManifest is the archive file listing the recorded responses
+	sessionManifest = "session.json"
+)
+
+// session is a recording of the HTTP responses of one collection: the Node
+// and Pod lists used for discovery and the body of every scrape. Pod lists are
+// stripped to the fields discovery uses. It is stored as a tar archive holding
+// session.json and one file per response body.
+type session struct {
+	Version    int             `json:"version"`
+	Host       string          `json:"host"`
+	RecordedAt time.Time       `json:"recordedAt"`
+	Entries    []*sessionEntry `json:"entries"`
+}
+
+// sessionEntry is a recorded request and its response
+type sessionEntry struct {
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Query       string    `json:"query,omitempty"`
+	Time        time.Time `json:"time"`
+	Duration    float64   `json:"durationSeconds"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+
+	// Error is set instead of a response when the request failed
+	Error string `json:"error,omitempty"`
+
+	// Body is the name of the archive file holding the response body
+	Body string `json:"body,omitempty"`
+	body []byte
+}
+
+// key identifies the request of the entry when replaying
+func (e *sessionEntry) key() string {
+	return requestKey(e.Method, e.Path, e.Query)
+}
+
+// requestKey identifies a request by method, path and query
+func requestKey(method, path, query string) string {
+	if query == "" {
+		return method + " " + path
+	}
+	return method + " " + path + "?" + query
+}
+
+// sessionRecorder is a transport that records every response passing through
+// it, so the clientset and scrapes sharing the transport are both captured
+type sessionRecorder struct {
+	next    http.RoundTripper
+	mutex   sync.Mutex
+	session session
+
+	// maxBytes, when positive, rejects larger responses before they are
+	// buffered, as scrapes do with -max-response-size
+	maxBytes int64
+}
+
+// newSessionRecorder creates a recorder for the cluster at host
+func newSessionRecorder(host string) *sessionRecorder {
+	return &sessionRecorder{
+		session: session{
+			Version:    sessionVersion,
+			Host:       host,
+			RecordedAt: time.Now().UTC(),
+		},
+	}
+}
+
+// wrap makes the recorder record the responses of rt. It is passed to
+// rest.Config.Wrap.
+func (r *sessionRecorder) wrap(rt http.RoundTripper) http.RoundTripper {
+	r.next = rt
+	return r
+}
+
+func (r *sessionRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	entry := &sessionEntry{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.RawQuery,
+		Time:   start.UTC(),
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		entry.Duration = time.Since(start).Seconds()
+		entry.Error = err.Error()
+		r.add(entry)
+		return nil, err
+	}
+
+	// Read the whole body so it can be both recorded and returned
+	body, err := r.readBody(resp)
+	resp.Body.Close()
+	entry.Duration = time.Since(start).Seconds()
+	if err != nil {
+		entry.Error = err.Error()
+		r.add(entry)
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry.Status = resp.StatusCode
+	entry.ContentType = resp.Header.Get("Content-Type")
+	entry.body = body
+	if req.Method == http.MethodGet && resp.StatusCode == http.StatusOK && isPodListPath(req.URL.Path) {
+		// Pod specs hold environment variables and other configuration that
+		// replay does not need, so only the fields discovery uses are kept
+		entry.body, err = stripPodList(body)
+		if err != nil {
+			entry.Status, entry.ContentType, entry.body = 0, "", nil
+			entry.Error = fmt.Sprintf("pod list not recorded: %v", err)
+		}
+	}
+	r.add(entry)
+	return resp, nil
+}
+
+// readBody reads the body of resp, up to maxBytes when it is set
+func (r *sessionRecorder) readBody(resp *http.Response) ([]byte, error) {
+	if r.maxBytes <= 0 {
+		return io.ReadAll(resp.Body)
+	}
+	if resp.ContentLength > r.maxBytes {
+		return nil, fmt.Errorf("response is %d bytes, over the %d byte limit", resp.ContentLength, r.maxBytes)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, r.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > r.maxBytes {
+		return nil, fmt.Errorf("response is over the %d byte limit", r.maxBytes)
+	}
+	return body, nil
+}
+
+// isPodListPath reports whether path lists pods, in a namespace or in all of them
+func isPodListPath(path string) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "api" && parts[2] == "pods":
+		return true
+	case len(parts) == 5 && parts[0] == "api" && parts[2] == "namespaces" && parts[4] == "pods":
+		return true
+	}
+	return false
+}
+
+// stripPodList reduces a JSON Pod list to the name, namespace, labels, phase
+// and IP of each pod
+func stripPodList(body []byte) ([]byte, error) {
+	var list v1.PodList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("decoding pod list: %w", err)
+	}
+
+	stripped := v1.PodList{
+		TypeMeta: list.TypeMeta,
+		ListMeta: metav1.ListMeta{ResourceVersion: list.ResourceVersion},
+		Items:    make([]v1.Pod, 0, len(list.Items)),
+	}
+	for _, pod := range list.Items {
+		stripped.Items = append(stripped.Items, v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+				Labels:    pod.Labels,
+			},
+			Status: v1.PodStatus{
+				Phase: pod.Status.Phase,
+				PodIP: pod.Status.PodIP,
+			},
+		})
+	}
+	return json.Marshal(stripped)
+}
+
+// add appends entry to the session and names its body file
+func (r *sessionRecorder) add(entry *sessionEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if entry.Error == "" {
+		entry.Body = fmt.Sprintf("responses/%04d%s", len(r.session.Entries)+1, bodyFileSuffix(entry.Path))
+	}
+	r.session.Entries = append(r.session.Entries, entry)
+}
+
+// bodyFileSuffix turns a request path into a readable file name suffix, such
+// as -api-v1-nodes for /api/v1/nodes
+func bodyFileSuffix(path string) string {
+	suffix := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_':
+			return r
+		}
+		return '-'
+	}, path)
+	return strings.TrimRight(suffix, "-")
+}
+
+// write stores the recorded session as a tar archive at path
+func (r *sessionRecorder) write(path string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating session archive: %w", err)
+	}
+
+	if err := r.session.writeTar(f); err != nil {
+		f.Close()
+		return fmt.Errorf("writing session archive %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// writeTar writes the manifest followed by every response body
+func (s *session) writeTar(w io.Writer) error {
+	manifest, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, sessionManifest, manifest, s.RecordedAt); err != nil {
+		return err
+	}
+	for _, entry := range s.Entries {
+		if entry.Body == "" {
+			continue
+		}
+		if err := writeTarFile(tw, entry.Body, entry.body, entry.Time); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeTarFile adds a regular file to an archive
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// readSession loads a session archive written by kubeprom record
+func readSession(path string) (*session, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening session archive: %w", err)
+	}
+	defer f.Close()
+
+	var manifest []byte
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading session archive %s: %w", path, err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s from session archive %s: %w", header.Name, path, err)
+		}
+		if header.Name == sessionManifest {
+			manifest = data
+			continue
+		}
+		files[header.Name] = data
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("session archive %s has no %s", path, sessionManifest)
+	}
+
+	var s session
+	if err := json.Unmarshal(manifest, &s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", sessionManifest, err)
+	}
+	if s.Version != sessionVersion {
+		return nil, fmt.Errorf("unsupported session version %d, expected %d", s.Version, sessionVersion)
+	}
+	for _, entry := range s.Entries {
+		if entry.Body == "" {
+			continue
+		}
+		body, ok := files[entry.Body]
+		if !ok {
+			return nil, fmt.Errorf("session archive %s is missing %s", path, entry.Body)
+		}
+		entry.body = body
+	}
+	return &s, nil
+}
+
+// client returns cluster clients that replay the session instead of reaching
+// a cluster. The clientset is a regular one, so discovery decodes the
+// recorded Node and Pod lists exactly as it did when recording.
+func (s *session) client() (*clusterClient, error) {
+	return newClusterClient(&rest.Config{
+		Host:      s.Host,
+		Transport: newSessionReplayer(s),
+	})
+}
+
+// sessionReplayer is a transport that answers requests with the recorded
+// responses of a session. Requests recorded several times get their responses
+// in order, repeating the last one; unrecorded requests get a 404.
+type sessionReplayer struct {
+	mutex   sync.Mutex
+	entries map[string][]*sessionEntry
+	served  map[string]int
+}
+
+// newSessionReplayer creates a replaying transport for s
+func newSessionReplayer(s *session) *sessionReplayer {
+	r := &sessionReplayer{
+		entries: make(map[string][]*sessionEntry),
+		served:  make(map[string]int),
+	}
+	for _, entry := range s.Entries {
+		r.entries[entry.key()] = append(r.entries[entry.key()], entry)
+	}
+	return r
+}
+
+func (r *sessionReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	entry := r.next(requestKey(req.Method, req.URL.Path, req.URL.RawQuery))
+	if entry == nil {
+		return replayResponse(req, http.StatusNotFound, "text/plain; charset=utf-8",
+			[]byte(fmt.Sprintf("%s %s was not recorded in the session\n", req.Method, req.URL.RequestURI()))), nil
+	}
+	if entry.Error != "" {
+		return nil, errors.New(entry.Error)
+	}
+	return replayResponse(req, entry.Status, entry.ContentType, entry.body), nil
+}
+
+// next returns the next recorded entry for key, or nil if there is none
+func (r *sessionReplayer) next(key string) *sessionEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entries := r.entries[key]
+	if len(entries) == 0 {
+		return nil
+	}
+	i := min(r.served[key], len(entries)-1)
+	r.served[key]++
+	return entries[i]
+}
+
+// replayResponse builds the response to req from a recorded status and body
+func replayResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// runRecord collects metrics once and saves every response it received,
+// including discovery, to a session archive that -replay can run against
+func runRecord(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	var cluster clusterFlags
+	var out string
+
+	cluster.register(fs)
+	fs.StringVar(&out, "out", "", "Session archive to write (required)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s record -out <session.tar> [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Collect metrics once and record the raw responses of every scrape, together\n")
+		fmt.Fprintf(fs.Output(), "with the Node and Pod lists used for discovery, to a tar archive. Any command\n")
+		fmt.Fprintf(fs.Output(), "given -replay <session.tar> then runs against the recording instead of a cluster.\n\n")
+		fmt.Fprintf(fs.Output(), "Examples:\n")
+		fmt.Fprintf(fs.Output(), "  %s record -out session.tar\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s -replay session.tar -query 'kubelet_running_pods'\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	cluster.parse(fs, args)
+
+	if out == "" {
+		fmt.Fprintf(os.Stderr, "Error: -out parameter is required\n\n")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if cluster.replay != "" || cluster.contexts != "" || cluster.allContexts || cluster.direct {
+		fmt.Fprintf(os.Stderr, "Error: record captures a single cluster through the API server; -replay, -contexts, -all-contexts and -direct cannot be used\n")
+		os.Exit(1)
+	}
+
+	config, err := cluster.restConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: building kubeconfig: %v\n", err)
+		os.Exit(1)
+	}
+	recorder := newSessionRecorder(config.Host)
+	config.Wrap(recorder.wrap)
+
+	client, err := cluster.newClient(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	recorder.maxBytes = client.maxResponseSize
+
+	store, err := collectOnce([]*clusterClient{client}, DefaultEngineOptions(), cluster.debug)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	if err := recorder.write(out); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Recorded %d responses to %s\n", len(recorder.session.Entries), out)
+	for _, target := range store.Targets() {
+		if target.Health == healthUp {
+			fmt.Fprintf(os.Stderr, "  %-20s up (%d metric families)\n", target.Name, target.Families)
+		} else {
+			fmt.Fprintf(os.Stderr, "  %-20s down: %s\n", target.Name, target.LastError)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func TestRecordReplay(t *testing.T) {
+	cluster := newStandardFakeCluster(t)
+	cluster.serveError(podProxyPath("kube-system", "kube-controller-manager-node-a", 10257, "metrics"), http.StatusServiceUnavailable)
+
+	// Record through a real clientset, so discovery is recorded too
+	config := &rest.Config{Host: cluster.server.URL}
+	recorder := newSessionRecorder(config.Host)
+	config.Wrap(recorder.wrap)
+	client, err := newClusterClient(config)
+	if err != nil {
+		t.Fatalf("newClusterClient: %v", err)
+	}
+
+	ctx := context.Background()
+	recorded := newTestStore(t)
+	if err := collectAllMetrics(ctx, recorded, client, false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "session.tar")
+	if err := recorder.write(path); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	keys := make(map[string]bool)
+	for _, entry := range recorder.session.Entries {
+		keys[entry.key()] = true
+	}
+	for _, key := range []string{
+		"GET /api/v1/nodes?limit=1",
+		"GET /api/v1/namespaces/kube-system/pods?labelSelector=" + url.QueryEscape("component=kube-scheduler"),
+		"GET /metrics",
+		"GET " + nodeProxyPath("node-a", "metrics/cadvisor"),
+	} {
+		if !keys[key] {
+			t.Errorf("%s was not recorded", key)
+		}
+	}
+
+	s, err := readSession(path)
+	if err != nil {
+		t.Fatalf("readSession: %v", err)
+	}
+	replayClient, err := s.client()
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+
+	requests := len(cluster.requested())
+	replayed := newTestStore(t)
+	if err := collectAllMetrics(ctx, replayed, replayClient, false); err != nil {
+		t.Fatalf("collectAllMetrics: %v", err)
+	}
+	if got := len(cluster.requested()); got != requests {
+		t.Errorf("replay sent %d requests to the cluster", got-requests)
+	}
+
+	recordedTargets := targetsByName(recorded)
+	replayedTargets := targetsByName(replayed)
+	if len(replayedTargets) != len(recordedTargets) {
+		t.Errorf("replayed %d targets, recorded %d", len(replayedTargets), len(recordedTargets))
+	}
+	for name, want := range recordedTargets {
+		got := replayedTargets[name]
+		if got.Health != want.Health || got.Families != want.Families || got.LastError != want.LastError {
+			t.Errorf("target %s: replayed %s/%d/%q, recorded %s/%d/%q",
+				name, got.Health, got.Families, got.LastError, want.Health, want.Families, want.LastError)
+		}
+	}
+	if target := recordedTargets["controller-manager"]; target.Health != healthDown {
+		t.Errorf("controller-manager health = %s, want %s", target.Health, healthDown)
+	}
+	if target := recordedTargets["scheduler"]; target.Health != healthUp {
+		t.Errorf("scheduler health = %s (%s), want %s", target.Health, target.LastError, healthUp)
+	}
+
+	for _, query := range []string{
+		"kubelet_running_pods",
+		"apiserver_request_total",
+		"sum by (pod) (container_memory_working_set_bytes)",
+		"scheduler_pending_pods",
+	} {
+		got := queryValues(t, replayed, query)
+		want := queryValues(t, recorded, query)
+		if len(got) == 0 || len(got) != len(want) {
+			t.Errorf("%s: replayed %v, recorded %v", query, got, want)
+			continue
+		}
+		for lbls, value := range want {
+			if got[lbls] != value {
+				t.Errorf("%s: %s replayed %v, recorded %v", query, lbls, got[lbls], value)
+			}
+		}
+	}
+}
+
+func TestSessionReplayer(t *testing.T) {
+	s := &session{
+		Version: sessionVersion,
+		Host:    "https://cluster.example:6443",
+		Entries: []*sessionEntry{
+			{Method: http.MethodGet, Path: "/metrics", Status: http.StatusOK, body: []byte("first_metric 1\n")},
+			{Method: http.MethodGet, Path: "/metrics", Status: http.StatusOK, body: []byte("second_metric 2\n")},
+			{Method: http.MethodGet, Path: "/api/v1/nodes/node-a/proxy/metrics", Error: "connection refused"},
+		},
+	}
+	client, err := s.client()
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+
+	// Repeated requests get the recorded responses in order, then the last one
+	for _, want := range []string{"first_metric", "second_metric", "second_metric"} {
+		result, err := client.scrapePath(context.Background(), "/metrics", nil)
+		if err != nil {
+			t.Fatalf("scrapePath: %v", err)
+		}
+		if _, ok := result.families[want]; len(result.families) != 1 || !ok {
+			t.Errorf("families = %v, want %s", sortedKeys(result.families), want)
+		}
+	}
+
+	_, err = client.scrapePath(context.Background(), nodeProxyPath("node-a", "metrics"), nil)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("error = %v, want the recorded error", err)
+	}
+
+	_, err = client.scrapePath(context.Background(), "/unrecorded", nil)
+	if err == nil || !strings.Contains(err.Error(), "was not recorded") {
+		t.Errorf("error = %v, want an unrecorded request error", err)
+	}
+}
+
+func TestRecordStripsPodLists(t *testing.T) {
+	pod := fakePod("kube-system", "kube-scheduler-node-a", map[string]string{"component": "kube-scheduler"})
+	pod.Annotations = map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"}
+	pod.Spec.Containers = []corev1.Container{{
+		Name:  "kube-scheduler",
+		Image: "registry.k8s.io/kube-scheduler:v1.33.0",
+		Env:   []corev1.EnvVar{{Name: "API_TOKEN", Value: "s3cr3t"}},
+	}}
+	cluster := newFakeCluster(t, fakeNode("node-a"), pod)
+
+	config := &rest.Config{Host: cluster.server.URL}
+	recorder := newSessionRecorder(config.Host)
+	config.Wrap(recorder.wrap)
+	client, err := newClusterClient(config)
+	if err != nil {
+		t.Fatalf("newClusterClient: %v", err)
+	}
+
+	// The caller still gets the full pod
+	ctx := context.Background()
+	opts := metav1.ListOptions{LabelSelector: "component=kube-scheduler"}
+	live, err := client.clientset.CoreV1().Pods("kube-system").List(ctx, opts)
+	if err != nil {
+		t.Fatalf("listing pods: %v", err)
+	}
+	if len(live.Items) != 1 || len(live.Items[0].Spec.Containers) != 1 {
+		t.Fatalf("listed pods = %+v, want the full scheduler pod", live.Items)
+	}
+
+	for _, entry := range recorder.session.Entries {
+		if strings.Contains(string(entry.body), "s3cr3t") || strings.Contains(string(entry.body), "last-applied-configuration") {
+			t.Errorf("%s recorded the pod spec: %s", entry.key(), entry.body)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "session.tar")
+	if err := recorder.write(path); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	s, err := readSession(path)
+	if err != nil {
+		t.Fatalf("readSession: %v", err)
+	}
+	replayClient, err := s.client()
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	replayed, err := replayClient.clientset.CoreV1().Pods("kube-system").List(ctx, opts)
+	if err != nil {
+		t.Fatalf("listing replayed pods: %v", err)
+	}
+	want := []corev1.Pod{{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      "kube-scheduler-node-a",
+			Labels:    map[string]string{"component": "kube-scheduler"},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.10"},
+	}}
+	if !reflect.DeepEqual(replayed.Items, want) {
+		t.Errorf("replayed pods = %+v, want %+v", replayed.Items, want)
+	}
+}
+
+func TestRecordUndecodablePodList(t *testing.T) {
+	recorder := newSessionRecorder("https://cluster.example:6443")
+	recorder.wrap(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return replayResponse(req, http.StatusOK, "application/vnd.kubernetes.protobuf", []byte("k8s\x00")), nil
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "https://cluster.example:6443/api/v1/namespaces/kube-system/pods", nil)
+	if _, err := recorder.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	entry := recorder.session.Entries[0]
+	if entry.body != nil || entry.Body != "" || !strings.Contains(entry.Error, "pod list not recorded") {
+		t.Errorf("entry = %+v, want the pod list left out", entry)
+	}
+}
+
+func TestRecordMaxResponseSize(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	tests := []struct {
+		name          string
+		maxBytes      int64
+		contentLength int64
+		wantErr       string
+	}{
+		{name: "no limit", maxBytes: 0, contentLength: -1},
+		{name: "at the limit", maxBytes: 100, contentLength: -1},
+		{name: "over the limit", maxBytes: 99, contentLength: -1, wantErr: "response is over the 99 byte limit"},
+		{name: "declared over the limit", maxBytes: 99, contentLength: 100, wantErr: "response is 100 bytes, over the 99 byte limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newSessionRecorder("https://cluster.example:6443")
+			recorder.maxBytes = tt.maxBytes
+			recorder.wrap(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				resp := replayResponse(req, http.StatusOK, "text/plain", []byte(body))
+				resp.ContentLength = tt.contentLength
+				return resp, nil
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "https://cluster.example:6443/metrics", nil)
+			_, err := recorder.RoundTrip(req)
+			entry := recorder.session.Entries[0]
+			if tt.wantErr == "" {
+				if err != nil || string(entry.body) != body {
+					t.Errorf("RoundTrip = %v, recorded %d bytes, want the whole body", err, len(entry.body))
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("RoundTrip = %v, want %q", err, tt.wantErr)
+			}
+			if entry.body != nil || entry.Body != "" || entry.Error != tt.wantErr {
+				t.Errorf("entry = %+v, want the error recorded without a body", entry)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/term"
+)
+
+const shellPrompt = "kubeprom> "
+
+// maxCompletionCandidates caps the number of candidates listed on tab
+const maxCompletionCandidates = 100
+
+// promqlKeywords are completed alongside metric and function names
+var promqlKeywords = []string{
+	"sum", "min", "max", "avg", "group", "stddev", "stdvar", "count", "count_values",
+	"bottomk", "topk", "quantile", "limitk", "limit_ratio",
+	"by", "without", "on", "ignoring", "group_left", "group_right",
+	"and", "or", "unless", "bool", "offset", "start", "end",
+}
+
+// groupingKeywords are followed by a parenthesised list of label names
+var groupingKeywords = []string{"by", "without", "on", "ignoring", "group_left", "group_right"}
+
+// shell is an interactive PromQL session over a single metric store
+type shell struct {
+	*storeCollector
+	output string
+}
+
+// runShell runs the interactive PromQL shell
+func runShell(args []string) {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	var cluster clusterFlags
+	var refresh time.Duration
+	var output string
+	var rulesPattern string
+	engineOpts := DefaultEngineOptions()
+
+	cluster.register(fs)
+	fs.StringVar(&rulesPattern, "rules", "",
+		"Prometheus rule file, or glob of rule files, whose recording and alerting rules are evaluated after each collection")
+	fs.DurationVar(&refresh, "refresh", 0,
+		"Collect metrics again in the background at this interval (0 collects once)")
+	fs.StringVar(&output, "output", outputTable,
+		"Initial output format: table or json")
+	addEngineFlags(fs, &engineOpts)
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s shell [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Interactive PromQL shell. Metrics are collected once, or every -refresh\n")
+		fmt.Fprintf(fs.Output(), "interval, and queries are evaluated against the collected data.\n\n")
+		fmt.Fprintf(fs.Output(), "Examples:\n")
+		fmt.Fprintf(fs.Output(), "  %s shell\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s shell -refresh 30s\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	cluster.parse(fs, args)
+
+	if err := validateOutputFormat(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := applyEngineFlags(engineOpts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ruleGroups, err := loadRules(rulesPattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	clients, err := cluster.clients()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	store, err := NewMetricStore(engineOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to create metric store: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	sh := &shell{
+		storeCollector: &storeCollector{
+			store:      store,
+			clients:    clients,
+			cluster:    cluster,
+			ruleGroups: ruleGroups,
+		},
+		output: output,
+	}
+
+	fmt.Fprintln(os.Stderr, "Collecting metrics from Kubernetes components...")
+	sh.collect()
+	sh.printSummary()
+
+	if refresh > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go sh.collectEvery(ctx, refresh)
+	}
+
+	fmt.Println("Type a PromQL query, or .help for commands. Press Tab to complete.")
+	if err := sh.run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// printSummary reports how many targets were scraped successfully
+func (sh *shell) printSummary() {
+	targets := sh.store.Targets()
+	up := 0
+	for _, target := range targets {
+		if target.Health == healthUp {
+			up++
+		}
+	}
+	fmt.Printf("Collected metrics from %d of %d targets (.targets for details)\n", up, len(targets))
+}
+
+// run reads and executes lines until end of input. Line editing, history and
+// tab completion are only available when stdin is a terminal.
+func (sh *shell) run() error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if sh.execute(scanner.Text()) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, shellPrompt)
+	terminal.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return sh.complete(terminal, line, pos)
+	}
+
+	for {
+		// The terminal is only raw while editing, so command output prints normally
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("setting terminal to raw mode: %w", err)
+		}
+		line, err := terminal.ReadLine()
+		term.Restore(fd, oldState)
+
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sh.execute(line) {
+			return nil
+		}
+	}
+}
+
+// execute runs a query or meta-command and reports whether the shell should exit
+func (sh *shell) execute(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return false
+	}
+	if strings.HasPrefix(line, ".") {
+		return sh.executeCommand(strings.Fields(line))
+	}
+
+	if _, err := parser.ParseExpr(line); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid PromQL query: %v\n", err)
+		return false
+	}
+
+	result, err := sh.store.ExecutePromQLAt(context.Background(), line, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return false
+	}
+	if err := displayQueryResults(sh.output, []queryOutput{{QueryResult: result}}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	return false
+}
+
+// executeCommand runs a meta-command and reports whether the shell should exit
+func (sh *shell) executeCommand(fields []string) bool {
+	switch fields[0] {
+	case ".quit", ".exit":
+		return true
+	case ".help":
+		fmt.Println("Commands:")
+		fmt.Println("  .refresh               Collect metrics from the cluster again")
+		fmt.Println("  .targets               Show the scrape status of every target")
+		fmt.Println("  .format [table|json]   Show or set the output format")
+		fmt.Println("  .help                  Show this help")
+		fmt.Println("  .quit, .exit           Leave the shell")
+	case ".refresh":
+		fmt.Fprintln(os.Stderr, "Collecting metrics from Kubernetes components...")
+		sh.collect()
+		sh.printSummary()
+	case ".targets":
+		if err := displayTargets(sh.output, sh.store.Targets()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	case ".format":
+		if len(fields) < 2 {
+			fmt.Printf("Output format: %s\n", sh.output)
+			break
+		}
+		if err := validateOutputFormat(fields[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			break
+		}
+		sh.output = fields[1]
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown command %s (try .help)\n", fields[0])
+	}
+	return false
+}
+
+// complete completes the word before the cursor. A single match replaces the
+// word, several matches are narrowed to their common prefix and listed.
+func (sh *shell) complete(terminal *term.Terminal, line string, pos int) (string, int, bool) {
+	start, candidates := sh.completionCandidates(line[:pos])
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	word := line[start:pos]
+	completion := candidates[0]
+	if len(candidates) > 1 {
+		completion = commonPrefix(candidates)
+		if completion == word {
+			listed := candidates
+			if len(listed) > maxCompletionCandidates {
+				listed = listed[:maxCompletionCandidates]
+			}
+			fmt.Fprintf(terminal, "%s\n", strings.Join(listed, "  "))
+			if len(candidates) > len(listed) {
+				fmt.Fprintf(terminal, "... and %d more\n", len(candidates)-len(listed))
+			}
+			return line, pos, true
+		}
+	}
+
+	newLine := line[:start] + completion + line[pos:]
+	return newLine, start + len(completion), true
+}
+
+// completionCandidates returns the start of the word being completed in prefix
+// and the sorted candidates for it, based on where the cursor is:
+// label values inside a quoted matcher, label names inside braces or grouping
+// clauses, and metric, function and keyword names everywhere else.
+func (sh *shell) completionCandidates(prefix string) (int, []string) {
+	ctx := context.Background()
+	querier, err := sh.store.storage.Querier(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return len(prefix), nil
+	}
+	defer querier.Close()
+
+	// Inside braces we complete label names, or label values within quotes
+	if open := strings.LastIndex(prefix, "{"); open > strings.LastIndex(prefix, "}") {
+		var matchers []*labels.Matcher
+		if metric := prefix[identifierStart(prefix[:open]):open]; metric != "" {
+			matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, metric))
+		}
+
+		inside := prefix[open+1:]
+		if quote := strings.LastIndex(inside, `"`); strings.Count(inside, `"`)%2 == 1 {
+			// The label name precedes the matcher operator before the quote
+			beforeOp := strings.TrimRight(inside[:quote], "=!~ ")
+			name := beforeOp[identifierStart(beforeOp):]
+			values, _, err := querier.LabelValues(ctx, name, nil, matchers...)
+			if err != nil {
+				return len(prefix), nil
+			}
+			start := open + 1 + quote + 1
+			return start, filterPrefix(values, prefix[start:])
+		}
+
+		start := identifierStart(prefix)
+		names, _, err := querier.LabelNames(ctx, nil, matchers...)
+		if err != nil {
+			return start, nil
+		}
+		return start, filterPrefix(names, prefix[start:])
+	}
+
+	start := identifierStart(prefix)
+	word := prefix[start:]
+
+	// Grouping clauses like "by (" and "on (" take label names
+	if open := strings.LastIndex(prefix, "("); open > strings.LastIndex(prefix, ")") {
+		before := strings.TrimSpace(prefix[:open])
+		for _, keyword := range groupingKeywords {
+			if strings.HasSuffix(before, keyword) {
+				names, _, err := querier.LabelNames(ctx, nil)
+				if err != nil {
+					return start, nil
+				}
+				return start, filterPrefix(names, word)
+			}
+		}
+	}
+
+	metrics, _, err := querier.LabelValues(ctx, labels.MetricName, nil)
+	if err != nil {
+		return start, nil
+	}
+	candidates := filterPrefix(metrics, word)
+	for name := range parser.Functions {
+		if strings.HasPrefix(name, word) {
+			candidates = append(candidates, name)
+		}
+	}
+	candidates = append(candidates, filterPrefix(promqlKeywords, word)...)
+
+	slices.Sort(candidates)
+	return start, slices.Compact(candidates)
+}
+
+// identifierStart returns the index at which the identifier ending s begins
+func identifierStart(s string) int {
+	i := len(s)
+	for i > 0 {
+		c := s[i-1]
+		if c != '_' && c != ':' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			break
+		}
+		i--
+	}
+	return i
+}
+
+// filterPrefix returns the values that start with prefix
+func filterPrefix(values []string, prefix string) []string {
+	var matches []string
+	for _, value := range values {
+		if strings.HasPrefix(value, prefix) {
+			matches = append(matches, value)
+		}
+	}
+	return matches
+}
+
+// commonPrefix returns the longest prefix shared by all values
+func commonPrefix(values []string) string {
+	prefix := values[0]
+	for _, value := range values[1:] {
+		for !strings.HasPrefix(value, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
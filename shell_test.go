@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestShellCompletionCandidates(t *testing.T) {
+	store := newTestStore(t)
+	for _, lbls := range []labels.Labels{
+		labels.FromStrings(labels.MetricName, "kubelet_running_pods", "node", "node-a"),
+		labels.FromStrings(labels.MetricName, "kubelet_running_containers", "container_state", "running", "node", "node-a"),
+		labels.FromStrings(labels.MetricName, "kubelet_running_containers", "container_state", "exited", "node", "node-a"),
+		labels.FromStrings(labels.MetricName, "apiserver_request_total", "code", "200", "verb", "GET"),
+	} {
+		store.appendSample(lbls, 1000, 1)
+	}
+	sh := &shell{storeCollector: &storeCollector{store: store}}
+
+	tests := []struct {
+		prefix    string
+		wantStart int
+		want      []string
+	}{
+		{"kubelet_run", 0, []string{"kubelet_running_containers", "kubelet_running_pods"}},
+		{"sum(kubelet_running_p", 4, []string{"kubelet_running_pods"}},
+		{"rat", 0, []string{"rate"}},
+		{"topk(3, apiserver_", 8, []string{"apiserver_request_total"}},
+		{"kubelet_running_containers{con", 27, []string{"container_state"}},
+		{"kubelet_running_pods{", 21, []string{"__name__", "node"}},
+		{`kubelet_running_containers{container_state="r`, 44, []string{"running"}},
+		{`kubelet_running_containers{container_state=~"`, 45, []string{"exited", "running"}},
+		{`apiserver_request_total{code="200", ve`, 36, []string{"verb"}},
+		{"sum by (no", 8, []string{"node"}},
+		{"sum(kubelet_running_pods) without (", 35, []string{"__name__", "code", "container_state", "node", "verb"}},
+		{"zzz", 0, nil},
+	}
+	for _, tt := range tests {
+		start, got := sh.completionCandidates(tt.prefix)
+		if start != tt.wantStart || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("completionCandidates(%q) = %d, %q, want %d, %q", tt.prefix, start, got, tt.wantStart, tt.want)
+		}
+	}
+}
+
+func TestIdentifierStart(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"kubelet_running_pods", 0},
+		{"sum(rate", 4},
+		{"job:requests:rate5m", 0},
+		{"x{y", 2},
+		{"sum by (", 8},
+		{"a + b2", 4},
+	}
+	for _, tt := range tests {
+		if got := identifierStart(tt.s); got != tt.want {
+			t.Errorf("identifierStart(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"rate"}, "rate"},
+		{[]string{"kubelet_running_containers", "kubelet_running_pods"}, "kubelet_running_"},
+		{[]string{"rate", "rate"}, "rate"},
+		{[]string{"abs", "rate"}, ""},
+		{[]string{"sum", "sum_over_time", "sort"}, "s"},
+	}
+	for _, tt := range tests {
+		if got := commonPrefix(tt.values); got != tt.want {
+			t.Errorf("commonPrefix(%q) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/util/annotations"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Target health values
+const (
+	healthUp   = "up"
+	healthDown = "down"
+)
+
+// Kinds of scrape failure, telling RBAC denials apart from unreachable
+// components and from malformed responses
+const (
+	errorKindForbidden    = "forbidden"
+	errorKindUnauthorized = "unauthorized"
+	errorKindNotFound     = "not-found"
+	errorKindRateLimited  = "rate-limited"
+	errorKindServerError  = "server-error"
+	errorKindRefused      = "connection-refused"
+	errorKindTimeout      = "timeout"
+	errorKindParse        = "parse-error"
+	errorKindOther        = "other"
+)
+
+// TargetStatus describes the outcome of the last scrape of a target.
+// Labels identify the target, by job and instance; only the cluster label is
+// added to its series. DiscoveredLabels hold the address, scheme and path
+// scraped and the node or pod found by discovery.
+type TargetStatus struct {
+	Name             string            `json:"name"`
+	Cluster          string            `json:"cluster,omitempty"`
+	ScrapeURL        string            `json:"scrapeUrl,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	DiscoveredLabels map[string]string `json:"discoveredLabels,omitempty"`
+	LastScrape       time.Time         `json:"lastScrape"`
+	Duration         time.Duration     `json:"duration"`
+	Families         int               `json:"families"`
+	Samples          int               `json:"samples"`
+	Retries          int               `json:"retries"`
+	Health           string            `json:"health"`
+	LastError        string            `json:"lastError,omitempty"`
+	ErrorKind        string            `json:"errorKind,omitempty"`
+}
+
+// countSamples returns the number of samples families add to the store
+func countSamples(families map[string]*dto.MetricFamily) int {
+	samples := 0
+	for _, family := range families {
+		samples += len(family.Metric)
+	}
+	return samples
+}
+
+// errorKind classifies a scrape failure
+func errorKind(err error) string {
+	code := 0
+	var statusErr *scrapeStatusError
+	var apiStatus apierrors.APIStatus
+	switch {
+	case errors.As(err, &statusErr):
+		code = statusErr.StatusCode
+	case errors.As(err, &apiStatus):
+		code = int(apiStatus.Status().Code)
+	}
+
+	var netErr net.Error
+	var parseErr *parseError
+	switch {
+	case code == http.StatusForbidden:
+		return errorKindForbidden
+	case code == http.StatusUnauthorized:
+		return errorKindUnauthorized
+	case code == http.StatusNotFound:
+		return errorKindNotFound
+	case code == http.StatusTooManyRequests:
+		return errorKindRateLimited
+	case code >= 500:
+		return errorKindServerError
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorKindRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorKindTimeout
+	case errors.As(err, &parseErr):
+		return errorKindParse
+	default:
+		return errorKindOther
+	}
+}
+
+// UpdateTarget records the outcome of the latest scrape of a target
+func (s *MetricStore) UpdateTarget(status TargetStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.targets[status.Name] = status
+}
+
+// retriesMetric records the retries of the last scrape of each component
+const retriesMetric = "kubeprom_scrape_retries"
+
+// addRetries records the retries of the last scrape of component as a
+// retriesMetric series with the target labels
+func (s *MetricStore) addRetries(component string, targetLabels labels.Labels, retries int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	builder := labels.NewBuilder(targetLabels)
+	builder.Set(labels.MetricName, retriesMetric)
+	builder.Set("component", component)
+	s.setMetadata(retriesMetric, "kubeprom", MetricMetadata{
+		Type: model.MetricTypeGauge,
+		Help: "Number of times the last scrape of the component was retried.",
+	})
+	s.appendSample(builder.Labels(), time.Now().UnixMilli(), float64(retries))
+}
+
+// Targets returns the status of every scraped target sorted by name
+func (s *MetricStore) Targets() []TargetStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	targets := make([]TargetStatus, 0, len(s.targets))
+	for _, target := range s.targets {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Name < targets[j].Name
+	})
+	return targets
+}
+
+// runTargets collects metrics once and reports the scrape status of every
+// discovered target
+func runTargets(args []string) {
+	fs := flag.NewFlagSet("targets", flag.ExitOnError)
+	var cluster clusterFlags
+	var output string
+	var health string
+
+	cluster.register(fs)
+	fs.StringVar(&output, "output", outputTable,
+		"Output format: table or json")
+	fs.StringVar(&health, "health", "",
+		"Only list targets with this health: up or down")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s targets [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Collect metrics once and list every discovered target with the URL or API\n")
+		fmt.Fprintf(fs.Output(), "server proxy path it was scraped on, its labels, the time, duration, samples\n")
+		fmt.Fprintf(fs.Output(), "and retries of its scrape, its health and the kind and text of its last error.\n\n")
+		fmt.Fprintf(fs.Output(), "Examples:\n")
+		fmt.Fprintf(fs.Output(), "  %s targets\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s targets -health down\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  %s targets -output json\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	cluster.parse(fs, args)
+
+	if err := validateOutputFormat(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+	if health != "" && health != healthUp && health != healthDown {
+		fmt.Fprintf(os.Stderr, "Error: -health must be %s or %s\n\n", healthUp, healthDown)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	store, err := cluster.collect(DefaultEngineOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	targets := store.Targets()
+	if health != "" {
+		filtered := targets[:0]
+		for _, target := range targets {
+			if target.Health == health {
+				filtered = append(filtered, target)
+			}
+		}
+		targets = filtered
+	}
+	if err := displayTargets(output, targets); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// storageWarnings returns a warning for every target whose last scrape failed,
+// so partial results are reported with every query.
+// The caller must hold the store mutex.
+func (s *MetricStore) storageWarnings() annotations.Annotations {
+	var warnings annotations.Annotations
+	for name, target := range s.targets {
+		if target.Health == healthDown {
+			warnings.Add(fmt.Errorf("failed to collect metrics from %s: %s", name, target.LastError))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestErrorKind(t *testing.T) {
+	// A listener that is closed again refuses connections on its address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, refused := scrapeMetrics(context.Background(), http.DefaultClient, "http://"+address+"/metrics", 0)
+
+	pods := schema.GroupResource{Resource: "pods"}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"proxy forbidden", &scrapeStatusError{StatusCode: http.StatusForbidden}, errorKindForbidden},
+		{"discovery forbidden", fmt.Errorf("listing pods: %w", apierrors.NewForbidden(pods, "", errors.New("RBAC"))), errorKindForbidden},
+		{"unauthorized", &scrapeStatusError{StatusCode: http.StatusUnauthorized}, errorKindUnauthorized},
+		{"not found", &scrapeStatusError{StatusCode: http.StatusNotFound}, errorKindNotFound},
+		{"rate limited", apierrors.NewTooManyRequests("slow down", 1), errorKindRateLimited},
+		{"bad gateway", &scrapeStatusError{StatusCode: http.StatusBadGateway}, errorKindServerError},
+		{"connection refused", refused, errorKindRefused},
+		{"timeout", fmt.Errorf("failed to GET: %w", context.DeadlineExceeded), errorKindTimeout},
+		{"parse", &parseError{url: "http://node/metrics", err: errors.New("unexpected end of input")}, errorKindParse},
+		{"other", errors.New("no kube-scheduler pods found"), errorKindOther},
+	}
+	for _, tt := range tests {
+		if got := errorKind(tt.err); got != tt.want {
+			t.Errorf("%s: errorKind(%v) = %q, want %q", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/rules"
+	"gopkg.in/yaml.v3"
+)
+
+// sampleEpsilon is the relative tolerance used when comparing sample values
+const sampleEpsilon = 1e-6
+
+// ruleTestFile is the promtool rule unit test file layout
+type ruleTestFile struct {
+	RuleFiles          []string       `yaml:"rule_files"`
+	EvaluationInterval model.Duration `yaml:"evaluation_interval"`
+	Tests              []ruleTestCase `yaml:"tests"`
+}
+
+// ruleTestCase is a single test: input series and the expected alerts and query results
+type ruleTestCase struct {
+	Name           string           `yaml:"name"`
+	Interval       model.Duration   `yaml:"interval"`
+	InputSeries    []inputSeries    `yaml:"input_series"`
+	AlertRuleTests []alertRuleTest  `yaml:"alert_rule_test"`
+	PromQLTests    []promqlExprTest `yaml:"promql_expr_test"`
+}
+
+// inputSeries is a series in promtool notation, such as foo{a="b"} with values 0+10x10
+type inputSeries struct {
+	Series string `yaml:"series"`
+	Values string `yaml:"values"`
+}
+
+// alertRuleTest lists the alerts expected to be firing for an alert name at a time
+type alertRuleTest struct {
+	EvalTime  model.Duration `yaml:"eval_time"`
+	Alertname string         `yaml:"alertname"`
+	ExpAlerts []expAlert     `yaml:"exp_alerts"`
+}
+
+// expAlert is an expected firing alert
+type expAlert struct {
+	ExpLabels      map[string]string `yaml:"exp_labels"`
+	ExpAnnotations map[string]string `yaml:"exp_annotations"`
+}
+
+// promqlExprTest lists the samples a query is expected to return at a time
+type promqlExprTest struct {
+	Expr       string         `yaml:"expr"`
+	EvalTime   model.Duration `yaml:"eval_time"`
+	ExpSamples []expSample    `yaml:"exp_samples"`
+}
+
+// expSample is an expected query result sample
+type expSample struct {
+	Labels string  `yaml:"labels"`
+	Value  float64 `yaml:"value"`
+}
+
+// runTest dispatches the test subcommands
+func runTest(args []string) {
+	if len(args) == 0 || args[0] != "rules" {
+		fmt.Fprintf(os.Stderr, "Usage: %s test rules <test-file>...\n", os.Args[0])
+		os.Exit(1)
+	}
+	runTestRules(args[1:])
+}
+
+// runTestRules runs rule unit tests written in the promtool test file format
+func runTestRules(args []string) {
+	fs := flag.NewFlagSet("test rules", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s test rules <test-file>...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Run unit tests for recording and alerting rules, written in the same format as\n")
+		fmt.Fprintf(os.Stderr, "`promtool test rules`, against an empty metric store with the kubeprom engine.\n\n")
+		fmt.Fprintf(os.Stderr, "Examples:\n")
+		fmt.Fprintf(os.Stderr, "  %s test rules tests.yaml\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s test rules tests/*.yaml\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, file := range fs.Args() {
+		fmt.Printf("Unit Testing: %s\n", file)
+		errs := ruleUnitTestFile(file)
+		if len(errs) == 0 {
+			fmt.Println("  SUCCESS")
+			continue
+		}
+		failed = true
+		fmt.Println("  FAILED:")
+		for _, err := range errs {
+			fmt.Printf("    %s\n", strings.ReplaceAll(err.Error(), "\n", "\n    "))
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// ruleUnitTestFile runs every test of a test file and returns the failures
+func ruleUnitTestFile(file string) []error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return []error{fmt.Errorf("reading test file: %w", err)}
+	}
+
+	var testFile ruleTestFile
+	if err := yaml.Unmarshal(data, &testFile); err != nil {
+		return []error{fmt.Errorf("parsing test file: %w", err)}
+	}
+	if testFile.EvaluationInterval == 0 {
+		testFile.EvaluationInterval = model.Duration(time.Minute)
+	}
+
+	// Rule files are relative to the test file
+	ruleFiles := make([]string, 0, len(testFile.RuleFiles))
+	for _, ruleFile := range testFile.RuleFiles {
+		if !filepath.IsAbs(ruleFile) {
+			ruleFile = filepath.Join(filepath.Dir(file), ruleFile)
+		}
+		ruleFiles = append(ruleFiles, ruleFile)
+	}
+
+	var errs []error
+	for i, test := range testFile.Tests {
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		for _, err := range test.run(ruleFiles, time.Duration(testFile.EvaluationInterval)) {
+			errs = append(errs, fmt.Errorf("test %s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// run loads the input series into a fresh store, evaluates the rules at every
+// evaluation interval up to the last tested time, and checks the expectations
+func (test ruleTestCase) run(ruleFiles []string, evalInterval time.Duration) []error {
+	if test.Interval == 0 {
+		test.Interval = model.Duration(evalInterval)
+	}
+
+	store, err := NewMetricStore(DefaultEngineOptions())
+	if err != nil {
+		return []error{err}
+	}
+	defer store.Close()
+
+	if err := test.loadInputSeries(store); err != nil {
+		return []error{err}
+	}
+
+	// Rules are loaded per test so alert state does not leak between tests
+	var groups []*ruleGroup
+	for _, ruleFile := range ruleFiles {
+		fileGroups, err := loadRuleFiles(ruleFile)
+		if err != nil {
+			return []error{err}
+		}
+		groups = append(groups, fileGroups...)
+	}
+
+	alertTests := slices.Clone(test.AlertRuleTests)
+	sort.SliceStable(alertTests, func(i, j int) bool {
+		return alertTests[i].EvalTime < alertTests[j].EvalTime
+	})
+
+	// Evaluate rules at least up to the last time any expectation refers to,
+	// so queries also see the series recorded by rules
+	var maxEvalTime time.Duration
+	for _, alertTest := range alertTests {
+		maxEvalTime = max(maxEvalTime, time.Duration(alertTest.EvalTime))
+	}
+	for _, exprTest := range test.PromQLTests {
+		maxEvalTime = max(maxEvalTime, time.Duration(exprTest.EvalTime))
+	}
+
+	ctx := context.Background()
+	var errs []error
+	next := 0
+	for offset := time.Duration(0); offset <= maxEvalTime; offset += evalInterval {
+		if err := store.EvaluateRules(ctx, groups, testTime(offset)); err != nil {
+			errs = append(errs, err)
+		}
+		// Like promtool, check each alert test against the last evaluation at
+		// or before its eval_time, which is this one when the next evaluation
+		// comes after it
+		for ; next < len(alertTests) && time.Duration(alertTests[next].EvalTime) < offset+evalInterval; next++ {
+			if err := alertTests[next].check(groups); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, alertTest := range alertTests[next:] {
+		errs = append(errs, fmt.Errorf("alertname: %s, time: %s, was not evaluated", alertTest.Alertname, alertTest.EvalTime))
+	}
+
+	for _, exprTest := range test.PromQLTests {
+		if err := exprTest.check(ctx, store); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// loadInputSeries appends the samples of every input series, one per interval
+// starting at the test epoch
+func (test ruleTestCase) loadInputSeries(store *MetricStore) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, input := range test.InputSeries {
+		lbls, values, err := parser.ParseSeriesDesc(strings.TrimSpace(input.Series + " " + input.Values))
+		if err != nil {
+			return fmt.Errorf("parsing input series %q: %w", input.Series, err)
+		}
+		// The store only keeps the latest maxSamplesPerSeries samples, so a
+		// longer series would silently lose its earliest values
+		samples := 0
+		for _, value := range values {
+			if !value.Omitted {
+				samples++
+			}
+		}
+		if samples > maxSamplesPerSeries {
+			return fmt.Errorf("input series %q has %d samples, more than the %d kept per series", input.Series, samples, maxSamplesPerSeries)
+		}
+
+		for i, value := range values {
+			if value.Omitted {
+				continue
+			}
+			if value.Histogram != nil {
+				return fmt.Errorf("input series %q: native histograms are not supported", input.Series)
+			}
+			ts := testTime(time.Duration(i) * time.Duration(test.Interval))
+			store.appendSample(lbls, ts.UnixMilli(), value.Value)
+		}
+	}
+	return nil
+}
+
+// check compares the firing alerts of the rule named Alertname with ExpAlerts
+func (at alertRuleTest) check(groups []*ruleGroup) error {
+	var got []string
+	for _, alert := range activeAlerts(groups) {
+		if alert.Name == at.Alertname && alert.State == rules.StateFiring.String() {
+			got = append(got, formatAlert(alert.Labels, alert.Annotations))
+		}
+	}
+
+	exp := make([]string, 0, len(at.ExpAlerts))
+	for _, expected := range at.ExpAlerts {
+		lbls := map[string]string{labels.AlertName: at.Alertname}
+		for name, value := range expected.ExpLabels {
+			lbls[name] = value
+		}
+		exp = append(exp, formatAlert(lbls, expected.ExpAnnotations))
+	}
+
+	sort.Strings(got)
+	sort.Strings(exp)
+	if slices.Equal(got, exp) {
+		return nil
+	}
+	return fmt.Errorf("alertname: %s, time: %s,\n    exp:%s,\n    got:%s",
+		at.Alertname, at.EvalTime, formatList(exp), formatList(got))
+}
+
+// check evaluates Expr at EvalTime and compares the result with ExpSamples
+func (et promqlExprTest) check(ctx context.Context, store *MetricStore) error {
+	result, err := store.ExecutePromQLAt(ctx, et.Expr, testTime(time.Duration(et.EvalTime)))
+	if err != nil {
+		return fmt.Errorf("expr: %q, time: %s, err: %w", et.Expr, et.EvalTime, err)
+	}
+
+	got := make(map[string]float64, len(result.Results))
+	for _, sample := range result.Results {
+		got[labels.FromMap(sample.Labels).String()] = sample.Value
+	}
+
+	exp := make(map[string]float64, len(et.ExpSamples))
+	for _, sample := range et.ExpSamples {
+		lbls := labels.EmptyLabels()
+		if sample.Labels != "" {
+			lbls, err = parser.ParseMetric(sample.Labels)
+		}
+		if err != nil {
+			return fmt.Errorf("expr: %q, time: %s, parsing expected labels %q: %w", et.Expr, et.EvalTime, sample.Labels, err)
+		}
+		exp[lbls.String()] = sample.Value
+	}
+
+	match := len(got) == len(exp)
+	for lbls, value := range exp {
+		gotValue, ok := got[lbls]
+		if !ok || !almostEqual(gotValue, value) {
+			match = false
+			break
+		}
+	}
+	if match {
+		return nil
+	}
+	return fmt.Errorf("expr: %q, time: %s,\n    exp: %s\n    got: %s",
+		et.Expr, et.EvalTime, formatSamples(exp), formatSamples(got))
+}
+
+// testTime returns the time offset from the start of a test
+func testTime(offset time.Duration) time.Time {
+	return time.Unix(0, 0).UTC().Add(offset)
+}
+
+// almostEqual reports whether a and b are equal within sampleEpsilon
+func almostEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= sampleEpsilon*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// formatAlert formats the labels and annotations of an alert for comparison
+func formatAlert(lbls, annotations map[string]string) string {
+	return fmt.Sprintf("labels: %s, annotations: %s", labels.FromMap(lbls), labels.FromMap(annotations))
+}
+
+// formatList formats alerts one per line
+func formatList(items []string) string {
+	if len(items) == 0 {
+		return " []"
+	}
+	var b strings.Builder
+	for i, item := range items {
+		fmt.Fprintf(&b, "\n        %d: %s", i, item)
+	}
+	return b.String()
+}
+
+// formatSamples formats samples sorted by labels
+func formatSamples(samples map[string]float64) string {
+	parts := make([]string, 0, len(samples))
+	for _, lbls := range sortedKeys(samples) {
+		parts = append(parts, fmt.Sprintf("%s %g", lbls, samples[lbls]))
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// seriesSamples returns the samples of the series with the given labels as
+// offset=value strings
+func seriesSamples(t *testing.T, store *MetricStore, series string) []string {
+	t.Helper()
+
+	ts, ok := store.series[series]
+	if !ok {
+		t.Fatalf("series %s not found", series)
+	}
+	var samples []string
+	it := ts.Iterator(nil)
+	for it.Next() == chunkenc.ValFloat {
+		at, v := it.At()
+		if value.IsStaleNaN(v) {
+			samples = append(samples, fmt.Sprintf("%s=stale", time.Duration(at)*time.Millisecond))
+			continue
+		}
+		samples = append(samples, fmt.Sprintf("%s=%g", time.Duration(at)*time.Millisecond, v))
+	}
+	return samples
+}
+
+func TestLoadInputSeries(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		values   string
+		want     []string
+		wantErr  string
+	}{
+		{name: "expanding", interval: time.Minute, values: "1+2x3", want: []string{"0s=1", "1m0s=3", "2m0s=5", "3m0s=7"}},
+		{name: "decreasing", interval: time.Minute, values: "5-1x2", want: []string{"0s=5", "1m0s=4", "2m0s=3"}},
+		{name: "repeated", interval: 30 * time.Second, values: "4x2", want: []string{"0s=4", "30s=4", "1m0s=4"}},
+		{name: "omitted", interval: time.Minute, values: "1 _ 3 _x2 6", want: []string{"0s=1", "2m0s=3", "5m0s=6"}},
+		{name: "stale", interval: time.Minute, values: "1 stale 3", want: []string{"0s=1", "1m0s=stale", "2m0s=3"}},
+		{name: "maximum", interval: time.Second, values: fmt.Sprintf("0+1x%d", maxSamplesPerSeries-1), want: nil},
+		{name: "too many", interval: time.Second, values: fmt.Sprintf("0+1x%d", maxSamplesPerSeries), wantErr: "has 1001 samples, more than the 1000 kept per series"},
+		{name: "omitted samples do not count", interval: time.Second, values: fmt.Sprintf("_x10 0+1x%d", maxSamplesPerSeries-1), want: nil},
+		{name: "invalid", interval: time.Minute, values: "1 +", wantErr: "parsing input series"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			test := ruleTestCase{
+				Interval:    model.Duration(tt.interval),
+				InputSeries: []inputSeries{{Series: `test_metric{job="test"}`, Values: tt.values}},
+			}
+			err := test.loadInputSeries(store)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadInputSeries = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samples := seriesSamples(t, store, labels.FromStrings(labels.MetricName, "test_metric", "job", "test").String())
+			if tt.want == nil {
+				// Long series are checked by length only
+				if len(samples) != maxSamplesPerSeries {
+					t.Errorf("series has %d samples, want %d", len(samples), maxSamplesPerSeries)
+				}
+				return
+			}
+			if !reflect.DeepEqual(samples, tt.want) {
+				t.Errorf("samples = %q, want %q", samples, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertRuleTestCheck(t *testing.T) {
+	const ruleFile = `groups:
+- name: test
+  rules:
+  - alert: TestMetricHigh
+    expr: test_metric > 20
+    for: 1m
+    labels:
+      severity: warning
+    annotations:
+      summary: test_metric is {{ $value }}
+`
+	firing := expAlert{
+		ExpLabels:      map[string]string{"job": "test", "severity": "warning"},
+		ExpAnnotations: map[string]string{"summary": "test_metric is 40"},
+	}
+
+	tests := []struct {
+		name      string
+		evalTimes []time.Duration
+		exp       []expAlert
+		wantErr   string
+	}{
+		{name: "pending alerts are not firing", evalTimes: []time.Duration{10 * time.Minute}},
+		{name: "firing", evalTimes: []time.Duration{9 * time.Minute, 10 * time.Minute}, exp: []expAlert{firing}},
+		{
+			name:      "missing alert",
+			evalTimes: []time.Duration{10 * time.Minute},
+			exp:       []expAlert{firing},
+			wantErr:   "alertname: TestMetricHigh, time: 10m,\n    exp:\n        0: labels: {alertname=\"TestMetricHigh\", job=\"test\", severity=\"warning\"}, annotations: {summary=\"test_metric is 40\"},\n    got: []",
+		},
+		{
+			name:      "wrong annotations",
+			evalTimes: []time.Duration{9 * time.Minute, 10 * time.Minute},
+			exp: []expAlert{{
+				ExpLabels:      firing.ExpLabels,
+				ExpAnnotations: map[string]string{"summary": "test_metric is 41"},
+			}},
+			wantErr: `got:
+        0: labels: {alertname="TestMetricHigh", job="test", severity="warning"}, annotations: {summary="test_metric is 40"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := writeRuleFile(t, ruleFile)
+			store := newEngineTestStore(t, DefaultEngineOptions())
+			for _, offset := range tt.evalTimes {
+				if err := store.EvaluateRules(context.Background(), groups, testTime(offset)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			at := alertRuleTest{
+				EvalTime:  model.Duration(tt.evalTimes[len(tt.evalTimes)-1]),
+				Alertname: "TestMetricHigh",
+				ExpAlerts: tt.exp,
+			}
+			err := at.check(groups)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("check = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleTestOffIntervalEvalTime(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(ruleFile, []byte(`groups:
+- name: test
+  rules:
+  - alert: TestMetricHigh
+    expr: test_metric > 1
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	firing := []expAlert{{ExpLabels: map[string]string{"job": "test"}}}
+
+	tests := []struct {
+		name       string
+		alertTests []alertRuleTest
+		wantErrs   []string
+	}{
+		{
+			// 90s is checked against the evaluation at 1m, before the
+			// alert fires at 2m, and 150s against the one at 2m
+			name: "between evaluations",
+			alertTests: []alertRuleTest{
+				{EvalTime: model.Duration(90 * time.Second), Alertname: "TestMetricHigh"},
+				{EvalTime: model.Duration(150 * time.Second), Alertname: "TestMetricHigh", ExpAlerts: firing},
+			},
+		},
+		{
+			name: "wrong expectations are reported",
+			alertTests: []alertRuleTest{
+				{EvalTime: model.Duration(90 * time.Second), Alertname: "TestMetricHigh", ExpAlerts: firing},
+				{EvalTime: model.Duration(150 * time.Second), Alertname: "TestMetricHigh"},
+			},
+			wantErrs: []string{
+				"alertname: TestMetricHigh, time: 1m30s,",
+				"alertname: TestMetricHigh, time: 2m30s,",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := ruleTestCase{
+				Interval:       model.Duration(time.Minute),
+				InputSeries:    []inputSeries{{Series: `test_metric{job="test"}`, Values: "0 0 5 5"}},
+				AlertRuleTests: tt.alertTests,
+			}
+			errs := test.run([]string{ruleFile}, time.Minute)
+			if len(errs) != len(tt.wantErrs) {
+				t.Fatalf("run returned %v, want %d errors", errs, len(tt.wantErrs))
+			}
+			for i, err := range errs {
+				if !strings.HasPrefix(err.Error(), tt.wantErrs[i]) {
+					t.Errorf("error %d = %q, want prefix %q", i, err, tt.wantErrs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPromQLExprTestCheck(t *testing.T) {
+	store := newEngineTestStore(t, DefaultEngineOptions())
+
+	tests := []struct {
+		name    string
+		test    promqlExprTest
+		wantErr string
+	}{
+		{
+			name: "matching sample",
+			test: promqlExprTest{
+				Expr:       "test_metric",
+				EvalTime:   model.Duration(10 * time.Minute),
+				ExpSamples: []expSample{{Labels: `test_metric{job="test"}`, Value: 40}},
+			},
+		},
+		{
+			name: "within tolerance",
+			test: promqlExprTest{
+				Expr:       "test_metric / 3",
+				EvalTime:   model.Duration(10 * time.Minute),
+				ExpSamples: []expSample{{Labels: `{job="test"}`, Value: 13.333333}},
+			},
+		},
+		{
+			name: "scalar without labels",
+			test: promqlExprTest{
+				Expr:       "sum(test_metric)",
+				EvalTime:   model.Duration(5 * time.Minute),
+				ExpSamples: []expSample{{Value: 20}},
+			},
+		},
+		{
+			name: "empty result",
+			test: promqlExprTest{Expr: "test_metric > 100", EvalTime: model.Duration(10 * time.Minute)},
+		},
+		{
+			name: "wrong value",
+			test: promqlExprTest{
+				Expr:       "test_metric",
+				EvalTime:   model.Duration(10 * time.Minute),
+				ExpSamples: []expSample{{Labels: `test_metric{job="test"}`, Value: 39}},
+			},
+			wantErr: `exp: [{__name__="test_metric", job="test"} 39]` + "\n    got: " + `[{__name__="test_metric", job="test"} 40]`,
+		},
+		{
+			name: "unexpected series",
+			test: promqlExprTest{
+				Expr:       `test_metric or label_replace(test_metric, "copy", "1", "", "")`,
+				EvalTime:   model.Duration(10 * time.Minute),
+				ExpSamples: []expSample{{Labels: `test_metric{job="test"}`, Value: 40}},
+			},
+			wantErr: `got: [{__name__="test_metric", copy="1", job="test"} 40, {__name__="test_metric", job="test"} 40]`,
+		},
+		{
+			name: "invalid expected labels",
+			test: promqlExprTest{
+				Expr:       "test_metric",
+				EvalTime:   model.Duration(10 * time.Minute),
+				ExpSamples: []expSample{{Labels: `test_metric{job=`, Value: 40}},
+			},
+			wantErr: `parsing expected labels "test_metric{job="`,
+		},
+		{
+			name:    "invalid expression",
+			test:    promqlExprTest{Expr: "sum(", EvalTime: model.Duration(10 * time.Minute)},
+			wantErr: `expr: "sum(", time: 10m, err: invalid PromQL query`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.test.check(context.Background(), store)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("check = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleUnitTestFile(t *testing.T) {
+	if errs := ruleUnitTestFile("testdata/rules/alerts_test.yaml"); len(errs) != 0 {
+		t.Errorf("alerts_test.yaml failed: %v", errs)
+	}
+
+	errs := ruleUnitTestFile("testdata/rules/failing_test.yaml")
+	want := []string{
+		`test wrong expectations: alertname: KubeletTooManyPods, time: 10m,`,
+		`test wrong expectations: expr: "kubelet_running_pods", time: 10m,`,
+		`test too many samples: input series "kubelet_running_pods{node=\"node-a\"}" has 1001 samples`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("failing_test.yaml returned %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), want[i]) {
+			t.Errorf("error %d = %q, want prefix %q", i, err, want[i])
+		}
+	}
+
+	errs = ruleUnitTestFile("testdata/rules/missing_test.yaml")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "reading test file") {
+		t.Errorf("missing test file returned %v, want a reading error", errs)
+	}
+}
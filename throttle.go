@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// Defaults protecting the API server from the scrapes of a collection
+const (
+	defaultQPS             = 5
+	defaultBurst           = 10
+	defaultMaxInFlight     = 4
+	defaultMaxResponseSize = 100 // MiB
+
+	// minBackoff and maxBackoff bound the pause after the API server rejects
+	// a request with 429 Too Many Requests without a Retry-After header
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// API Priority and Fairness headers set on the requests it classifies,
+// including those it rejects
+const (
+	headerFlowSchema    = "X-Kubernetes-PF-FlowSchema-UID"
+	headerPriorityLevel = "X-Kubernetes-PF-PriorityLevel-UID"
+)
+
+// apiThrottle protects the API server from the requests of a collection. It
+// holds the rate limiter shared by the clientset and the scrapes, caps the
+// scrapes in flight, and pauses all of them after the API server rejects one
+// with 429 Too Many Requests, as it does when Priority and Fairness sheds load.
+type apiThrottle struct {
+	limiter  flowcontrol.RateLimiter
+	inFlight chan struct{}
+
+	mutex   sync.Mutex
+	until   time.Time     // no request is sent before until
+	backoff time.Duration // pause after the next 429 without Retry-After
+}
+
+// newAPIThrottle returns a throttle allowing qps requests per second with
+// bursts of burst, or any rate when qps is not positive, and at most
+// maxInFlight scrapes at once
+func newAPIThrottle(qps float32, burst, maxInFlight int) *apiThrottle {
+	limiter := flowcontrol.NewFakeAlwaysRateLimiter()
+	if qps > 0 {
+		limiter = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	}
+	return &apiThrottle{
+		limiter:  limiter,
+		inFlight: make(chan struct{}, maxInFlight),
+		backoff:  minBackoff,
+	}
+}
+
+// wrap returns a transport sending requests through next once the throttle
+// allows them. The in-flight slot of a request is held until its response
+// body is closed.
+func (t *apiThrottle) wrap(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		release, err := t.acquire(req.Context())
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		t.observe(resp)
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+		return resp, nil
+	})
+}
+
+// acquire waits for a pause to end, for a token and for an in-flight slot,
+// and returns the function releasing the slot
+func (t *apiThrottle) acquire(ctx context.Context) (func(), error) {
+	t.mutex.Lock()
+	pause := time.Until(t.until)
+	t.mutex.Unlock()
+	if pause > 0 {
+		timer := time.NewTimer(pause)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if err := t.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("client rate limiter: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case t.inFlight <- struct{}{}:
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-t.inFlight }) }, nil
+}
+
+// observe pauses requests after a 429 for the Retry-After the API server
+// asked for, or for a doubling backoff when it gave none, and resets the
+// backoff after any other response
+func (t *apiThrottle) observe(resp *http.Response) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.backoff = minBackoff
+		return
+	}
+
+	pause := t.backoff
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		pause = time.Duration(seconds) * time.Second
+	} else {
+		t.backoff = min(2*t.backoff, maxBackoff)
+	}
+	if until := time.Now().Add(pause); until.After(t.until) {
+		t.until = until
+	}
+}
+
+// rejection describes a 429 response for error messages, naming the
+// Priority and Fairness priority level that rejected it if any
+func rejection(resp *http.Response) string {
+	msg := "rate limited by the API server"
+	if level := resp.Header.Get(headerPriorityLevel); level != "" {
+		msg += fmt.Sprintf(" (priority level %s, flow schema %s)", level, resp.Header.Get(headerFlowSchema))
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		msg += fmt.Sprintf(", retry after %ss", retryAfter)
+	}
+	return msg
+}
+
+// releasingBody releases an in-flight slot when the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAPIThrottleInFlight(t *testing.T) {
+	var inFlight, maxSeen atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxSeen.Load()
+			if n <= seen || maxSeen.CompareAndSwap(seen, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("up 1\n"))
+	}))
+	defer server.Close()
+
+	throttle := newAPIThrottle(0, 0, 2)
+	client := &http.Client{Transport: throttle.wrap(http.DefaultTransport)}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := scrapeMetrics(context.Background(), client, server.URL+"/metrics", 0); err != nil {
+				t.Errorf("scrapeMetrics: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := maxSeen.Load(); got != 2 {
+		t.Errorf("at most %d scrapes were in flight, want 2", got)
+	}
+}
+
+func TestAPIThrottleTooManyRequests(t *testing.T) {
+	var retryAfter atomic.Value
+	retryAfter.Store("")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerFlowSchema, "flow-uid")
+		w.Header().Set(headerPriorityLevel, "level-uid")
+		if value := retryAfter.Load().(string); value != "" {
+			w.Header().Set("Retry-After", value)
+		}
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	throttle := newAPIThrottle(0, 0, 1)
+	client := &http.Client{Transport: throttle.wrap(http.DefaultTransport)}
+	pause := func() time.Duration {
+		throttle.mutex.Lock()
+		defer throttle.mutex.Unlock()
+		return time.Until(throttle.until)
+	}
+
+	retryAfter.Store("3")
+	_, err := scrapeMetrics(context.Background(), client, server.URL+"/metrics", 0)
+	if err == nil || !strings.Contains(err.Error(), "priority level level-uid") || !strings.Contains(err.Error(), "retry after 3s") {
+		t.Errorf("error = %v, want the rejecting priority level and Retry-After", err)
+	}
+	if got := pause(); got <= 2*time.Second || got > 3*time.Second {
+		t.Errorf("paused for %v, want the 3s of Retry-After", got)
+	}
+
+	// Requests wait for the pause to end
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = scrapeMetrics(ctx, client, server.URL+"/metrics", 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want the request to wait out the pause", err)
+	}
+
+	// Without Retry-After the pause doubles on every rejection
+	retryAfter.Store("")
+	for _, want := range []time.Duration{time.Second, 2 * time.Second} {
+		throttle.until = time.Time{}
+		scrapeMetrics(context.Background(), client, server.URL+"/metrics", 0)
+		if got := pause(); got <= want-time.Second/2 || got > want {
+			t.Errorf("paused for %v, want %v", got, want)
+		}
+	}
+
+	throttle.observe(&http.Response{StatusCode: http.StatusOK})
+	if throttle.backoff != minBackoff {
+		t.Errorf("backoff = %v after a success, want %v", throttle.backoff, minBackoff)
+	}
+}
+
+func TestScrapeMetricsMaxResponseSize(t *testing.T) {
+	body := strings.Repeat("kubelet_running_pods 3\n", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("stream") {
+			// Flushing drops Content-Length, so the size is only known once read
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/metrics", "/metrics?stream"} {
+		_, err := scrapeMetrics(context.Background(), server.Client(), server.URL+path, int64(len(body)-1))
+		if err == nil || !strings.Contains(err.Error(), "byte limit") {
+			t.Errorf("%s: error = %v, want the response to be over the limit", path, err)
+		}
+		families, err := scrapeMetrics(context.Background(), server.Client(), server.URL+path, int64(len(body)))
+		if err != nil {
+			t.Errorf("%s: scrapeMetrics: %v", path, err)
+		} else if _, ok := families["kubelet_running_pods"]; !ok {
+			t.Errorf("%s: kubelet_running_pods missing", path)
+		}
+	}
+}